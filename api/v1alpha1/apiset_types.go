@@ -1,6 +1,11 @@
 package v1alpha1
 
 import (
+	"net/http"
+	"slices"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -38,19 +43,172 @@ type Authentication struct {
 	PreShared *PreShared `json:"preShared,omitempty"`
 }
 
+// Passing of multipart/form-data request bodies as files.
+// Each field value is passed as FORM_<name in upper case> environment
+// variable, while each file is mounted at
+// <mountPath>/<name in lower case>/<file name>, with its path passed as
+// FORM_<name in upper case> instead.
+// Other characters than alphanumerics in names are replaced with _.
+// Request body is then not passed via REQUEST_BODY or stdin.
+type Form struct {
+	// Directory to mount files under
+	//+kubebuilder:default="/form"
+	MountPath string `json:"mountPath,omitempty"`
+
+	// Small files are passed via a Secret.
+	// Files too large for that are placed on this PersistentVolumeClaim,
+	// or rejected if not set.
+	PersistentVolumeClaim *PersistentVolumeClaimStorage `json:"persistentVolumeClaim,omitempty"`
+}
+
+// Detail of JSON schema validation errors in 422 responses, as output
+// formats of the JSON Schema specification
+type ValidationOutput string
+
+const (
+	// Only that the request body is invalid, without the schema revealed
+	ValidationOutputFlag ValidationOutput = "Flag"
+	// A flat list of errors, each with instanceLocation, keywordLocation
+	// and message
+	ValidationOutputBasic ValidationOutput = "Basic"
+	// As Basic, but nested by the schema structure, with errors of
+	// subschemas in errors of each entry
+	ValidationOutputDetailed ValidationOutput = "Detailed"
+)
+
 type Request struct {
 	// JSON Schema to validate requests with, as an inline object.
 	// Empty object may be used to enforce being JSON only.
-	Schema         *Schema         `json:"schema,omitempty"`
+	// Schemas shared in ConfigMaps of the namespace may be referred with
+	// $ref as configmap://<name>/<key>, and may refer to each other.
+	// They are resolved when the APISet is loaded.
+	Schema *Schema `json:"schema,omitempty"`
+
+	// Detail of validation errors responded, Flag for public APIs
+	//+kubebuilder:validation:Enum=Flag;Basic;Detailed
+	//+kubebuilder:default=Basic
+	ValidationOutput ValidationOutput `json:"validationOutput,omitempty"`
+
 	Authentication *Authentication `json:"authentication,omitempty"`
+
+	// Parse multipart/form-data request bodies and pass them as files
+	Form *Form `json:"form,omitempty"`
+}
+
+// Where CGI response is read from
+type ResponseSource string
+
+const (
+	// Read from container logs.
+	// Logs are line-oriented, and may be altered by the kubelet or log rotation.
+	ResponseSourceLog ResponseSource = "Log"
+	// Read from stdout of the container via attach, byte-exact.
+	// Output written before kcgid attaches is lost, thus the container is
+	// expected to have stdin, and read request body before writing output.
+	ResponseSourceAttach ResponseSource = "Attach"
+)
+
+// Files produced by the pod, collected into artifact storage when the CGI
+// script terminates.
+// A signed URL listing them is returned in X-KubeCGI-Artifacts response
+// header, and passed to the script as ARTIFACTS_URL environment variable.
+type Artifacts struct {
+	// Path of the directory to collect files from.
+	// An emptyDir is mounted on it.
+	Path string `json:"path"`
+
+	// Image of the sidecar container collecting the files,
+	// expected to contain sh, sleep, tar and touch commands.
+	//+kubebuilder:default="busybox:stable"
+	Image string `json:"image,omitempty"`
 }
 
 type Response struct {
+	// Source to read CGI response from.
+	//+kubebuilder:validation:Enum=Log;Attach
+	//+kubebuilder:default=Log
+	Source ResponseSource `json:"source,omitempty"`
+
+	// Collect files produced by the pod as artifacts.
+	// Requires artifactStorage of the APISet.
+	Artifacts *Artifacts `json:"artifacts,omitempty"`
+
+	// Send 103 Early Hints with X-KubeCGI-Phase header as the pod is observed
+	// progressing through Scheduling, Initializing, Creating, and Running.
+	// Only sent to HTTP/1.1 or later clients.
+	ProgressHints bool `json:"progressHints,omitempty"`
+
+	// JSON Schema of successful response bodies, as an inline object.
+	// Only published in the OpenAPI document, not validated.
+	Schema *Schema `json:"schema,omitempty"`
+
 	// TODO define CGI script failure behavior
 	// TODO also consider making this setable per-apiset
 }
 
-// A Pod is retained when it statisfies all specified rules
+// Dispatching of a batch/v1 Job for each request
+type JobDispatch struct {
+	// See batch/v1 Job
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// See batch/v1 Job
+	PodFailurePolicy *batchv1.PodFailurePolicy `json:"podFailurePolicy,omitempty"`
+	// See batch/v1 Job
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+//+kubebuilder:validation:XValidation:message="allowCredentials is not supported with * in allowOrigins",rule="!has(self.allowCredentials) || !self.allowCredentials || !('*' in self.allowOrigins)"
+
+// Cross-Origin Resource Sharing policy.
+// Preflight requests are answered without dispatching, and headers of
+// actual requests are merged with those from CGI scripts, where ones set by
+// scripts take precedence.
+type CORS struct {
+	// Origins allowed, as scheme://host[:port], or * for any
+	//+kubebuilder:validation:MinItems=1
+	//+kubebuilder:validation:MaxItems=32
+	//+kubebuilder:validation:items:MaxLength=256
+	AllowOrigins []string `json:"allowOrigins"`
+	// Methods allowed in preflight responses, defaults to methods of the API
+	AllowMethods []string `json:"allowMethods,omitempty"`
+	// Request headers allowed in preflight responses
+	AllowHeaders []string `json:"allowHeaders,omitempty"`
+	// Response headers exposed to scripts of origins
+	ExposeHeaders []string `json:"exposeHeaders,omitempty"`
+	// Allow requests with credentials, e.g. cookies
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+	// Seconds preflight responses may be cached
+	//+kubebuilder:validation:Minimum=0
+	MaxAgeSeconds *int32 `json:"maxAgeSeconds,omitempty"`
+}
+
+//+kubebuilder:validation:XValidation:message="retryLimit is not supported with job, use job.backoffLimit",rule="!has(self.job) || !has(self.retryLimit)"
+//+kubebuilder:validation:XValidation:message="schedulingTimeoutSeconds is not supported with job",rule="!has(self.job) || !has(self.schedulingTimeoutSeconds)"
+
+// How requests are dispatched to pods
+type Dispatch struct {
+	// Dispatch a batch/v1 Job instead of a bare Pod.
+	// Response is read from the first pod producing CGI headers, while pods
+	// failed before that are replaced as the Job allows.
+	// Pods replaced after that are not observed by the client.
+	// Requests with bodies not drained for env, and thus only streamable
+	// once, are rejected with 413.
+	Job *JobDispatch `json:"job,omitempty"`
+	// Number of fresh pods to dispatch when a pod fails before producing
+	// CGI headers due to eviction, preemption, or image pull errors.
+	// 503 is returned with the reason when exhausted, or once the pod has
+	// read a request body not drained for env, as it is only streamable once.
+	//+kubebuilder:validation:Minimum=0
+	RetryLimit *int32 `json:"retryLimit,omitempty"`
+	// Seconds a pod may wait for being scheduled. On expiry, the pod is
+	// deleted and retried as a failed dispatch under retryLimit, with the
+	// latest scheduling failures as the reason.
+	// Not supported with job.
+	//+kubebuilder:validation:Minimum=1
+	SchedulingTimeoutSeconds *int32 `json:"schedulingTimeoutSeconds,omitempty"`
+}
+
+// A Pod, or Job if dispatched so, is retained when it statisfies all
+// specified rules
 type HistoryLimitSpec struct {
 	// Retain at most this number of pods from current version.
 	// Defaults to 0 on succeeded, 5 on failed.
@@ -71,14 +229,33 @@ type HistoryLimit struct {
 	Failed    HistoryLimitSpec `json:"failed,omitempty"`
 }
 
+//+kubebuilder:validation:XValidation:message="Attach response source requires container with stdin",rule="!has(self.response) || !has(self.response.source) || self.response.source != 'Attach' || (has(self.podSpec.containers[0].stdin) && self.podSpec.containers[0].stdin == true)"
+
 type API struct {
 	// Path of this API endpoint.
 	// In GO net/http.ServeMux PATH pattern (without METHOD or HOST).
 	// Values of wildcard segments will be passed as PATH_VALUE_<identifier in upper case> environment variables.
 	// /readyz is reserved for internal readiness checks.
+	// /artifacts/ is reserved for artifact downloads if artifactStorage is set.
+	// /openapi.json is reserved for the OpenAPI document of the APISet.
 	//+kubebuilder:validation:Format=uri
 	Path string `json:"path"`
 
+	// HTTP methods to serve, or all if empty.
+	// Unless listed, HEAD and OPTIONS are answered without dispatching, and
+	// other methods with 405 Method Not Allowed if not served by other APIs
+	// of the same path.
+	//+kubebuilder:validation:items:Enum=GET;HEAD;POST;PUT;PATCH;DELETE;OPTIONS
+	//+listType=set
+	Methods []string `json:"methods,omitempty"`
+
+	// Host names this API is restricted to, among those of the APISet, or
+	// all if empty.
+	// Wildcard host names are not supported, as net/http.ServeMux HOST.
+	//+kubebuilder:validation:items:Format=hostname
+	//+listType=set
+	Hosts []string `json:"hosts,omitempty"`
+
 	// Spec of the pod.
 	// Only one container expected, restartPolicy must be Never.
 	// If stdin of the container is true, stdinOnce must also be true,
@@ -91,6 +268,146 @@ type API struct {
 
 	*Request  `json:"request,omitempty"`
 	*Response `json:"response,omitempty"`
+	*Dispatch `json:"dispatch,omitempty"`
+
+	// Overrides that of the APISet
+	*CORS `json:"cors,omitempty"`
+}
+
+// Methods served, as listed or all common ones
+func (a *API) ServedMethods() []string {
+	if len(a.Methods) != 0 {
+		return a.Methods
+	}
+	return []string{
+		http.MethodGet,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+	}
+}
+
+// Patterns without methods, one for each host if restricted
+func (a *API) HostPaths() []string {
+	if len(a.Hosts) == 0 {
+		return []string{a.Path}
+	}
+	hostPaths := make([]string, len(a.Hosts))
+	for i, host := range a.Hosts {
+		hostPaths[i] = host + a.Path
+	}
+	return hostPaths
+}
+
+// Patterns to register on net/http.ServeMux, one for each host and method
+func (a *API) Patterns() []string {
+	if len(a.Methods) == 0 {
+		return a.HostPaths()
+	}
+	patterns := []string{}
+	for _, hostPath := range a.HostPaths() {
+		for _, method := range a.Methods {
+			patterns = append(patterns, method+" "+hostPath)
+		}
+	}
+	return patterns
+}
+
+// CORSFor returns the effective CORS policy of the API, if any
+func (s *APISetSpec) CORSFor(api *API) *CORS {
+	if api.CORS != nil {
+		return api.CORS
+	}
+	return s.CORS
+}
+
+// Patterns registered by kcgid to answer OPTIONS of paths only served with
+// other methods, which other paths must not conflict with.
+// Those with hosts take precedence over ones without on net/http.ServeMux.
+func (s *APISetSpec) OptionsPatterns() []string {
+	patterns := []string{}
+	seen := map[string]bool{}
+	for _, api := range s.APIs {
+		for _, hostPath := range api.HostPaths() {
+			if seen[hostPath] {
+				continue
+			}
+			seen[hostPath] = true
+			implicit := true
+			for _, other := range s.APIs {
+				if other.Path != api.Path {
+					continue
+				}
+				listed := slices.Contains(other.Methods, http.MethodOptions)
+				if (listed || len(other.Methods) == 0) && slices.Contains(other.HostPaths(), hostPath) ||
+					listed && len(other.Hosts) == 0 {
+					implicit = false
+					break
+				}
+			}
+			if implicit {
+				patterns = append(patterns, http.MethodOptions+" "+hostPath)
+			}
+		}
+	}
+	return patterns
+}
+
+// Host names to serve on, including wildcard ones
+func (s *APISetSpec) AllHosts() []string {
+	return append([]string{s.Host}, s.Hosts...)
+}
+
+// MatchesHost reports whether host is among those to serve on, or matches
+// a wildcard one of them
+func (s *APISetSpec) MatchesHost(host string) bool {
+	for _, h := range s.AllHosts() {
+		if h == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			label, ok := strings.CutSuffix(host, suffix)
+			if ok && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type PersistentVolumeClaimStorage struct {
+	// Name of the PersistentVolumeClaim, mounted on kcgid, and also on API
+	// pods if used for forms.
+	// Should support ReadWriteMany unless all of them are on the same node.
+	ClaimName string `json:"claimName"`
+}
+
+// S3-compatible object storage, with path-style addressing
+type S3Storage struct {
+	// e.g. http://minio.minio.svc:9000
+	//+kubebuilder:validation:Format=uri
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	//+kubebuilder:default="us-east-1"
+	Region          string       `json:"region,omitempty"`
+	AccessKeyID     SecretKeyRef `json:"accessKeyId"`
+	SecretAccessKey SecretKeyRef `json:"secretAccessKey"`
+}
+
+// Where artifacts are stored and how they are served.
+// Only one of persistentVolumeClaim and s3 should be set.
+// Artifacts are served under /artifacts/ of the host.
+type ArtifactStorage struct {
+	PersistentVolumeClaim *PersistentVolumeClaimStorage `json:"persistentVolumeClaim,omitempty"`
+	S3                    *S3Storage                    `json:"s3,omitempty"`
+
+	// Key to sign download URLs with
+	SigningKey SecretKeyRef `json:"signingKey"`
+
+	// Seconds signed download URLs are valid for
+	//+kubebuilder:default=3600
+	URLExpiry int32 `json:"urlExpiry,omitempty"`
 }
 
 // Deployment settings of the distributed API runtime
@@ -98,20 +415,110 @@ type Kcgid struct {
 	//+kubebuilder:default=1
 	Replicas *int32 `json:"replicas,omitempty"`
 
+	// Arguments of kcgid, e.g. --shutdown-grace-period, which should fit in
+	// terminationGracePeriodSeconds of 30 together with --shutdown-delay
 	Args []string `json:"args,omitempty"`
 
 	// Create monitoring.coreos.com/v1 ServiceMonitor for distributed API
 	// runtime metrics
 	//+kubebuilder:default=false
 	ServiceMonitor bool `json:"serviceMonitor,omitempty"`
+
+	// Resources of the kcgid container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Extra environment variables of the kcgid container.
+	// APISET_NAMESPACE and APISET_NAME are set by the controller.
+	//+listType=map
+	//+listMapKey=name
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// Security context of the kcgid container
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// Security context of kcgid pods
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+
+	NodeSelector              map[string]string                 `json:"nodeSelector,omitempty"`
+	Tolerations               []corev1.Toleration               `json:"tolerations,omitempty"`
+	Affinity                  *corev1.Affinity                  `json:"affinity,omitempty"`
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	PriorityClassName         string                            `json:"priorityClassName,omitempty"`
+}
+
+// cert-manager issuer to request the certificate from
+type CertManagerIssuer struct {
+	Name string `json:"name"`
+	//+kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	//+kubebuilder:default=Issuer
+	Kind string `json:"kind,omitempty"`
+}
+
+// TLS of the Ingress, covering all hosts
+type IngressTLS struct {
+	// Secret of the certificate, defaults to <name of APISet>-tls
+	SecretName string `json:"secretName,omitempty"`
+
+	// Have cert-manager populate the Secret, with its annotations on Ingress
+	Issuer *CertManagerIssuer `json:"issuer,omitempty"`
+}
+
+// Settings of the networking.k8s.io/v1 Ingress
+type Ingress struct {
+	// Do not create Ingress, e.g. on clusters fronted differently
+	//+kubebuilder:default=false
+	Disabled bool `json:"disabled,omitempty"`
+
+	ClassName *string `json:"className,omitempty"`
+
+	TLS *IngressTLS `json:"tls,omitempty"`
+
+	// Extra annotations, e.g. for ingress controllers, taking precedence over
+	// those inherited from the APISet
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Extra labels, taking precedence over those inherited from the APISet
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
+// Gateway a gateway.networking.k8s.io/v1 HTTPRoute is attached to, in
+// place of networking.k8s.io/v1 Ingress.
+// Paths are matched exactly, by prefixes, or by regular expressions
+// according to their patterns.
+type GatewayRef struct {
+	Name string `json:"name"`
+	// Defaults to that of the APISet
+	Namespace string `json:"namespace,omitempty"`
+	// Listener of the Gateway to attach to, or all if not set
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// Format of error responses generated by kcgid
+type ErrorFormat string
+
+const (
+	// {"error": "message", "requestId": "id"}, as application/json.
+	// JSON schema validation errors are in errors member in both formats.
+	ErrorFormatSimple ErrorFormat = "Simple"
+	// RFC 9457 Problem Details, as application/problem+json.
+	// Request id is in instance, and the error class in class member.
+	ErrorFormatProblemDetails ErrorFormat = "ProblemDetails"
+)
+
+//+kubebuilder:validation:XValidation:message="ingress is not supported with gateway",rule="!has(self.gateway) || !has(self.ingress)"
+
 // APISetSpec defines the desired state of APISet
 type APISetSpec struct {
 	// The domain name this APISet should serve on
 	//+kubebuilder:validation:Format=hostname
 	Host string `json:"host"`
 
+	// Additional host names to serve on, or wildcard ones matching a single
+	// DNS label, e.g. *.example.com
+	//+kubebuilder:validation:items:Pattern=`^(\*\.)?[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	//+listType=set
+	Hosts []string `json:"hosts,omitempty"`
+
 	// The APIs to host under the specified domain name
 	APIs []API `json:"apis"`
 
@@ -124,6 +531,21 @@ type APISetSpec struct {
 	HoistImages *bool `json:"hoistImages,omitempty"`
 
 	*HistoryLimit `json:"historyLimit,omitempty"`
+
+	ArtifactStorage *ArtifactStorage `json:"artifactStorage,omitempty"`
+
+	// Format of error responses generated by kcgid, not those of scripts
+	//+kubebuilder:validation:Enum=Simple;ProblemDetails
+	//+kubebuilder:default=Simple
+	ErrorFormat ErrorFormat `json:"errorFormat,omitempty"`
+
+	// CORS policy of APIs, unless overridden
+	*CORS `json:"cors,omitempty"`
+
+	Ingress *Ingress `json:"ingress,omitempty"`
+
+	// Expose with Gateway API HTTPRoute instead of Ingress
+	Gateway *GatewayRef `json:"gateway,omitempty"`
 }
 
 // APISetStatus defines the observed state of APISet
@@ -133,16 +555,44 @@ type APISetStatus struct {
 	Deployment      *corev1.ObjectReference `json:"deployment,omitempty"`
 	Service         *corev1.ObjectReference `json:"service,omitempty"`
 	Ingress         *corev1.ObjectReference `json:"ingress,omitempty"`
+	HTTPRoute       *corev1.ObjectReference `json:"httpRoute,omitempty"`
 	ImagePullSecret *corev1.ObjectReference `json:"imagePullSecret,omitempty"`
 	ServiceMonitor  *corev1.ObjectReference `json:"serviceMonitor,omitempty"`
-	Deployed        *bool                   `json:"deployed,omitempty"`
+	// ConfigMap with the OpenAPI document as openapi.json
+	OpenAPI *corev1.ObjectReference `json:"openAPI,omitempty"`
+	// Whether objects are applied, see conditions for readiness
+	Deployed *bool `json:"deployed,omitempty"`
 
 	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Ready, Progressing, Degraded, and IngressReady or RouteAccepted
+	//+listType=map
+	//+listMapKey=type
+	//+patchStrategy=merge
+	//+patchMergeKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
+const (
+	// Whether kcgid is available and the APIs are exposed
+	ConditionReady = "Ready"
+	// Whether kcgid is rolling out
+	ConditionProgressing = "Progressing"
+	// Whether reconciling failed, or kcgid is not fully available
+	ConditionDegraded = "Degraded"
+	// Whether the Ingress is assigned a load balancer
+	ConditionIngressReady = "IngressReady"
+	// Whether the HTTPRoute is accepted by the Gateway, as reported by it
+	ConditionRouteAccepted = "RouteAccepted"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="Host",type="string",JSONPath=".spec.host",description="Host name this APISet is served under"
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description="Whether kcgid is available and the APIs are exposed"
+//+kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason",description="Reason of readiness"
+//+kubebuilder:printcolumn:name="Progressing",type="string",JSONPath=".status.conditions[?(@.type==\"Progressing\")].status",description="Whether kcgid is rolling out",priority=1
+//+kubebuilder:printcolumn:name="Degraded",type="string",JSONPath=".status.conditions[?(@.type==\"Degraded\")].status",description="Whether reconciling failed, or kcgid is not fully available",priority=1
 //+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description="CreationTimestamp is a timestamp representing the server time when this object was created. It is not guaranteed to be set in happens-before order across separate operations. Clients may not set this value. It is represented in RFC3339 form and is in UTC. Populated by the system. Read-only. Null for lists. More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata"
 
 // APISet is the Schema for the apisets API
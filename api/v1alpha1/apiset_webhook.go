@@ -1,6 +1,7 @@
 package v1alpha1
 
 import (
+	"context"
 	"net/http"
 
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -8,10 +9,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	"github.com/xdavidwu/kube-cgi/internal"
 	kcgischema "github.com/xdavidwu/kube-cgi/internal/schema"
 )
 
@@ -21,30 +24,39 @@ var apisetlog = logf.Log.WithName("apiset-resource")
 func (r *APISet) SetupWebhookWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
+		// not cached, as only few ConfigMaps are referred
+		WithValidator(&apisetValidator{Reader: mgr.GetAPIReader()}).
 		Complete()
 }
 
 //+kubebuilder:webhook:path=/validate-kube-cgi-aic-cs-nycu-edu-tw-v1alpha1-apiset,mutating=false,failurePolicy=fail,sideEffects=None,groups=kube-cgi.aic.cs.nycu.edu.tw,resources=apisets,verbs=create;update,versions=v1alpha1,name=vapiset.kb.io,admissionReviewVersions=v1
 
-var _ webhook.Validator = &APISet{}
+// validates with ConfigMaps referred by schemas
+type apisetValidator struct {
+	Reader client.Reader
+}
+
+var _ webhook.CustomValidator = &apisetValidator{}
 
-// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
-func (r *APISet) ValidateCreate() (admission.Warnings, error) {
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *apisetValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	r := obj.(*APISet)
 	apisetlog.Info("validate create", "name", r.Name)
 
-	return r.validate()
+	return r.validate(kcgischema.ConfigMapsFrom(ctx, v.Reader, r.Namespace))
 }
 
-// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
-func (r *APISet) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *apisetValidator) ValidateUpdate(ctx context.Context, old, obj runtime.Object) (admission.Warnings, error) {
+	r := obj.(*APISet)
 	apisetlog.Info("validate update", "name", r.Name)
 
-	return r.validate()
+	return r.validate(kcgischema.ConfigMapsFrom(ctx, v.Reader, r.Namespace))
 }
 
-// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
-func (r *APISet) ValidateDelete() (admission.Warnings, error) {
-	apisetlog.Info("validate delete", "name", r.Name)
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *apisetValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	apisetlog.Info("validate delete", "name", obj.(*APISet).Name)
 
 	return nil, nil
 }
@@ -61,22 +73,106 @@ func tryRegisterPattern(s *http.ServeMux, p string) (err error) {
 	return
 }
 
-func (r APISet) validate() (admission.Warnings, error) {
+// of APIs serving all methods, when checked against reserved paths
+var reservedMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// paths served by kcgid for the method, only in forms qualified with it, as
+// method-less ones would conflict with APIs of wildcard paths with methods,
+// e.g. GET /{id}, and GET ones with HEAD ones
+func reservedMux(method string, artifacts bool) *http.ServeMux {
+	s := &http.ServeMux{}
+	reserve := func(p string) {
+		s.HandleFunc(method+" "+p, fakeHandleFunc)
+	}
+	reserve(internal.KcgidReadinessEndpointPath)
+	reserve(internal.KcgidReadinessEndpointPath + "/")
+	// as registered by kcgid
+	get := method == http.MethodGet || method == http.MethodHead
+	if get {
+		reserve(internal.KcgidOpenAPIEndpointPath)
+	}
+	if artifacts {
+		reserve(internal.KcgidArtifactsEndpointPath)
+		if get {
+			reserve(internal.KcgidArtifactsEndpointPath + "{id}/{file...}")
+		}
+	}
+	return s
+}
+
+func (r APISet) validate(configMaps kcgischema.ConfigMaps) (admission.Warnings, error) {
 	tMux := &http.ServeMux{}
 	errs := []*field.Error{}
+
+	if s := r.Spec.ArtifactStorage; s != nil {
+		p := field.NewPath("spec", "artifactStorage")
+		if s.PersistentVolumeClaim == nil && s.S3 == nil {
+			errs = append(errs, field.Required(
+				p, "one of persistentVolumeClaim and s3 must be set"))
+		} else if s.PersistentVolumeClaim != nil && s.S3 != nil {
+			errs = append(errs, field.Forbidden(
+				p.Child("s3"), "only one of persistentVolumeClaim and s3 may be set"))
+		}
+	}
+
+	if r.Spec.Kcgid != nil {
+		for i, env := range r.Spec.Kcgid.Env {
+			if env.Name == internal.KcgidEnvAPISetNamespace || env.Name == internal.KcgidEnvAPISetName {
+				errs = append(errs, field.Forbidden(
+					field.NewPath("spec", "kcgid", "env").Index(i).Child("name"),
+					env.Name+" is set by the controller"))
+			}
+		}
+	}
+
 	path := field.NewPath("spec", "apis")
 	for i, api := range r.Spec.APIs {
 		p := path.Index(i)
-		if err := tryRegisterPattern(tMux, api.Path); err != nil {
-			errs = append(errs, field.Invalid(
-				p.Child("path"),
-				api.Path,
-				err.Error(),
-			))
+		methods := api.Methods
+		if len(methods) == 0 {
+			methods = reservedMethods
+		}
+		for _, method := range methods {
+			// anew for each, as APIs may share patterns.
+			// without hosts, as kcgid serves reserved paths on all hosts,
+			// while host-qualified patterns would take precedence
+			reserved := reservedMux(method, r.Spec.ArtifactStorage != nil)
+			if err := tryRegisterPattern(reserved, method+" "+api.Path); err != nil {
+				errs = append(errs, field.Invalid(
+					p.Child("path"),
+					api.Path,
+					"reserved: "+err.Error(),
+				))
+				break
+			}
+		}
+
+		for _, pattern := range api.Patterns() {
+			if err := tryRegisterPattern(tMux, pattern); err != nil {
+				errs = append(errs, field.Invalid(
+					p.Child("path"),
+					api.Path,
+					err.Error(),
+				))
+				break
+			}
+		}
+
+		for j, host := range api.Hosts {
+			if !r.Spec.MatchesHost(host) {
+				errs = append(errs, field.Invalid(
+					p.Child("hosts").Index(j),
+					host,
+					"not among hosts of the APISet",
+				))
+			}
 		}
 
 		if api.Request != nil && api.Request.Schema != nil {
-			_, err := kcgischema.CompileString(api.Request.Schema.RawJSON)
+			_, err := kcgischema.CompileString(api.Request.Schema.RawJSON, configMaps)
 			if err != nil {
 				errs = append(errs, field.Invalid(
 					p.Child("request", "schema"),
@@ -85,6 +181,24 @@ func (r APISet) validate() (admission.Warnings, error) {
 				))
 			}
 		}
+
+		if api.Response != nil && api.Response.Artifacts != nil &&
+			r.Spec.ArtifactStorage == nil {
+			errs = append(errs, field.Required(
+				field.NewPath("spec", "artifactStorage"),
+				"required by "+p.Child("response", "artifacts").String(),
+			))
+		}
+	}
+
+	for _, pattern := range r.Spec.OptionsPatterns() {
+		if err := tryRegisterPattern(tMux, pattern); err != nil {
+			errs = append(errs, field.Invalid(
+				path,
+				pattern,
+				"implicit OPTIONS pattern conflicts: "+err.Error(),
+			))
+		}
 	}
 
 	if len(errs) != 0 {
@@ -44,6 +44,16 @@ var _ = Describe("validation webhook", Ordered, func() {
 	updateObj.Name = "update"
 	BeforeAll(func(ctx SpecContext) {
 		Expect(k8sClient.Create(ctx, updateObj)).To(Succeed())
+		Expect(k8sClient.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "schemas",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"user.json": `{"type": "object", "properties": {"name": {"$ref": "name.json"}}}`,
+				"name.json": `{"type": "string"}`,
+			},
+		})).To(Succeed())
 	})
 
 	DescribeTable("when creating or updateing APISet",
@@ -74,5 +84,92 @@ var _ = Describe("validation webhook", Ordered, func() {
 
 		Entry("rejects when schema is not valid", "/valid", `{"type": "invalid"}`, "spec.apis[0].request.schema"),
 		Entry("rejects when path is not valid", "/{invalid", `{"type": "object"}`, "spec.apis[0].path"),
+		Entry("rejects when path is reserved", "/readyz", `{"type": "object"}`, "spec.apis[0].path"),
+		Entry("rejects when path is reserved for openapi", "/openapi.json", `{"type": "object"}`, "spec.apis[0].path"),
+
+		Entry("accepts when schema refers to configmap", "/valid", `{"$ref": "configmap://schemas/user.json"}`, ""),
+		Entry("rejects when referred configmap is missing", "/valid", `{"$ref": "configmap://missing/user.json"}`, "spec.apis[0].request.schema"),
+		Entry("rejects when referred key is missing", "/valid", `{"$ref": "configmap://schemas/missing.json"}`, "spec.apis[0].request.schema"),
+	)
+
+	DescribeTable("when APIs of the same path have methods",
+		func(ctx SpecContext, first, second []string, msg string) {
+			obj := buildAPISet("/items/{id}", `{"type": "object"}`)
+			obj.Name = "methods"
+			obj.Spec.APIs = append(obj.Spec.APIs, *obj.Spec.APIs[0].DeepCopy())
+			obj.Spec.APIs[0].Methods = first
+			obj.Spec.APIs[1].Methods = second
+			err := k8sClient.Create(ctx, obj, client.DryRunAll)
+			if msg == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(msg))
+			}
+		},
+		Entry("accepts different methods", []string{"GET"}, []string{"POST", "DELETE"}, ""),
+		Entry("accepts methods with one serving all", []string{"GET"}, nil, ""),
+		Entry("rejects the same method", []string{"GET"}, []string{"POST", "GET"}, "spec.apis[1].path"),
+	)
+
+	DescribeTable("when APIs have methods",
+		func(ctx SpecContext, path string, methods []string, msg string) {
+			obj := buildAPISet(path, `{"type": "object"}`)
+			obj.Name = "reserved"
+			obj.Spec.APIs[0].Methods = methods
+			err := k8sClient.Create(ctx, obj, client.DryRunAll)
+			if msg == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(msg))
+			}
+		},
+		Entry("accepts wildcard paths covering reserved ones", "/{id}", []string{"GET"}, ""),
+		Entry("accepts methods not served on reserved paths", "/openapi.json", []string{"POST"}, ""),
+		Entry("rejects methods served on reserved paths", "/readyz", []string{"GET"}, "spec.apis[0].path"),
+	)
+
+	It("rejects kcgid env set by the controller", func(ctx SpecContext) {
+		obj := buildAPISet("/valid", `{"type": "object"}`)
+		obj.Name = "env"
+		obj.Spec.Kcgid = &Kcgid{Env: []corev1.EnvVar{{Name: "APISET_NAME", Value: "other"}}}
+		err := k8sClient.Create(ctx, obj, client.DryRunAll)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.kcgid.env[0].name"))
+	})
+
+	It("rejects attach response source without stdin", func(ctx SpecContext) {
+		obj := buildAPISet("/valid", `{"type": "object"}`)
+		obj.Name = "attach"
+		obj.Spec.APIs[0].Response = &Response{Source: ResponseSourceAttach}
+		err := k8sClient.Create(ctx, obj, client.DryRunAll)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("requires container with stdin"))
+
+		obj.Spec.APIs[0].Containers[0].Stdin = true
+		obj.Spec.APIs[0].Containers[0].StdinOnce = true
+		Expect(k8sClient.Create(ctx, obj, client.DryRunAll)).To(Succeed())
+	})
+
+	DescribeTable("when APIs have hosts",
+		func(ctx SpecContext, path string, hosts []string, msg string) {
+			obj := buildAPISet(path, `{"type": "object"}`)
+			obj.Name = "hosts"
+			obj.Spec.Hosts = []string{"api.internal.example.local", "*.apps.example.local"}
+			obj.Spec.APIs[0].Hosts = hosts
+			err := k8sClient.Create(ctx, obj, client.DryRunAll)
+			if msg == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(msg))
+			}
+		},
+		Entry("accepts hosts of the APISet", "/valid", []string{"example.local", "api.internal.example.local"}, ""),
+		Entry("accepts hosts matching wildcard ones", "/valid", []string{"a.apps.example.local"}, ""),
+		Entry("rejects hosts not of the APISet", "/valid", []string{"other.example.local"}, "spec.apis[0].hosts[0]"),
+		Entry("rejects hosts beyond wildcard ones", "/valid", []string{"a.b.apps.example.local"}, "spec.apis[0].hosts[0]"),
+		Entry("rejects reserved paths with hosts", "/readyz", []string{"example.local"}, "spec.apis[0].path"),
 	)
 })
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -22,12 +26,24 @@ import (
 
 	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
 	"github.com/xdavidwu/kube-cgi/internal"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/artifacts"
 	kcgid "github.com/xdavidwu/kube-cgi/internal/cgid/kubernetes"
 	"github.com/xdavidwu/kube-cgi/internal/cgid/metrics"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/middlewares"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/routing"
 	"github.com/xdavidwu/kube-cgi/internal/log"
+	"github.com/xdavidwu/kube-cgi/internal/openapi"
 )
 
 func main() {
+	var delay, gracePeriod, buildTimeout time.Duration
+	flag.DurationVar(&buildTimeout, "build-timeout", 30*time.Second,
+		"How long to wait for resources referred by an APISet, e.g. secrets, when loading it.")
+	flag.DurationVar(&delay, "shutdown-delay", 5*time.Second,
+		"How long to keep accepting requests with readiness failing on shutdown, for load balancers to catch up.")
+	flag.DurationVar(&gracePeriod, "shutdown-grace-period", 20*time.Second,
+		"How long to wait for in-flight requests on shutdown, before releasing their pods.")
 	opts := log.BuildZapOptions(flag.CommandLine)
 	log := zap.New(zap.UseFlagOptions(&opts))
 	klog.SetLogger(log)
@@ -54,7 +70,6 @@ func main() {
 
 	namespace := os.Getenv(internal.KcgidEnvAPISetNamespace)
 	apiSetName := os.Getenv(internal.KcgidEnvAPISetName)
-	apiSetGeneration, _ := strconv.ParseInt(os.Getenv(internal.KcgidEnvAPISetGeneration), 10, 0)
 
 	scheme := runtime.NewScheme()
 	must(clientgoscheme.AddToScheme(scheme), "register client-go scheme")
@@ -64,55 +79,156 @@ func main() {
 	dynamicClient, err := client.NewWithWatch(config, client.Options{Scheme: scheme})
 	must(err, "create controller-runtime client")
 
-	var apiSet kubecgiv1alpha1.APISet
-	err = dynamicClient.Get(
-		context.Background(),
-		client.ObjectKey{Namespace: namespace, Name: apiSetName},
-		&apiSet,
-	)
-	must(err, "get apiset")
-
-	if apiSet.Generation < apiSetGeneration {
-		log.Error(nil, "stale APISet obtained", "generation", apiSet.Generation, "expected", apiSetGeneration)
-		panic("stale APISet obtained")
-	}
+	informers := kcgid.NewInformers(dynamicClient, namespace, apiSetName)
+	inflight := &kcgid.Inflight{}
 
-	ref, err := kcgid.OwnerReferenceOf(dynamicClient, &apiSet)
-	must(err, "set up ownerreference")
+	// handlers of the current APISet, swapped as a whole on changes, while
+	// in-flight requests finish with the previous ones
+	var apiMux atomic.Pointer[http.Handler]
+	build := func(apiSet *kubecgiv1alpha1.APISet) (http.Handler, error) {
+		ref, err := kcgid.OwnerReferenceOf(dynamicClient, apiSet)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up ownerreference: %w", err)
+		}
 
-	go kcgid.CollectGarbage(log.WithName("gc"), dynamicClient, &apiSet)
+		mux := &http.ServeMux{}
+		ctx, cancel := context.WithTimeout(context.Background(), buildTimeout)
+		defer cancel()
+
+		var artifacts *artifacts.Artifacts
+		if apiSet.Spec.ArtifactStorage != nil {
+			artifacts, err = kcgid.NewArtifacts(ctx, informers, apiSet.Spec.ArtifactStorage)
+			if err != nil {
+				return nil, fmt.Errorf("cannot set up artifact storage: %w", err)
+			}
+			mux.Handle(artifacts.Pattern(), artifacts)
+		}
 
-	mux := &http.ServeMux{}
-	for i := range apiSet.Spec.APIs {
-		mux.Handle(apiSet.Spec.APIs[i].Path, kcgid.KubernetesHandler{
-			Client:         dynamicClient,
-			OldClient:      oldClient,
-			ClientConfig:   config,
-			Spec:           &apiSet.Spec.APIs[i],
-			Namespace:      namespace,
-			OwnerReference: ref,
-			Generation:     apiSet.Generation,
-		})
+		doc, err := openapi.Build(apiSet, informers.ConfigMaps(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("cannot build openapi document: %w", err)
+		}
+		mux.Handle(http.MethodGet+" "+internal.KcgidOpenAPIEndpointPath, openapi.Handler(doc))
+
+		handlers := make([]http.Handler, len(apiSet.Spec.APIs))
+		for i := range apiSet.Spec.APIs {
+			handlers[i], err = kcgid.KubernetesHandler{
+				Client:         dynamicClient,
+				OldClient:      oldClient,
+				ClientConfig:   config,
+				Spec:           &apiSet.Spec.APIs[i],
+				CORS:           apiSet.Spec.CORSFor(&apiSet.Spec.APIs[i]),
+				Namespace:      namespace,
+				OwnerReference: ref,
+				Generation:     apiSet.Generation,
+				Artifacts:      artifacts,
+				Informers:      informers,
+				Inflight:       inflight,
+			}.Build(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		routing.Register(mux, &apiSet.Spec, handlers)
+
+		handler := routing.Handler(mux)
+		if apiSet.Spec.ErrorFormat == kubecgiv1alpha1.ErrorFormatProblemDetails {
+			return middlewares.WithProblemDetails(handler), nil
+		}
+		return handler, nil
 	}
+	var loadErr atomic.Pointer[error]
+	informers.OnAPISetChange(func(apiSet *kubecgiv1alpha1.APISet) error {
+		log := log.WithValues("generation", apiSet.Generation)
+		mux, err := build(apiSet)
+		if err != nil {
+			err = fmt.Errorf("cannot load apiset of generation %d: %w", apiSet.Generation, err)
+			loadErr.Store(&err)
+			log.Error(err, "keeping previous one if any, retrying")
+			return err
+		}
+		apiMux.Store(&mux)
+		loadErr.Store(nil)
+		log.Info("apiset loaded")
+		return nil
+	})
+	informers.Start(context.Background())
 
+	go kcgid.CollectGarbage(log.WithName("gc"), dynamicClient, informers)
+
+	var draining atomic.Bool
 	readinessHandler := http.StripPrefix(internal.KcgidReadinessEndpointPath, &healthz.Handler{
 		Checks: map[string]healthz.Checker{
 			"ping": healthz.Ping,
+			"shutdown": func(r *http.Request) error {
+				if draining.Load() {
+					return errors.New("shutting down")
+				}
+				return nil
+			},
 			"apiserver": func(r *http.Request) error {
-				err = oldClient.CoreV1().RESTClient().Get().AbsPath("/readyz").Do(r.Context()).Error()
+				err := oldClient.CoreV1().RESTClient().Get().AbsPath("/readyz").Do(r.Context()).Error()
 				if err != nil {
 					log.WithName("healthcheck").Error(err, "cannot reach apiserver")
 				}
 				return err
 			},
+			"informers": func(r *http.Request) error {
+				if !informers.HasSynced() {
+					return errors.New("informers not synced")
+				}
+				return nil
+			},
+			"apiset": func(r *http.Request) error {
+				// a previously loaded one still serves
+				if apiMux.Load() != nil {
+					return nil
+				}
+				if err := loadErr.Load(); err != nil {
+					return *err
+				}
+				return errors.New("apiset not loaded")
+			},
 		},
 	})
 
+	mux := &http.ServeMux{}
 	mux.Handle(internal.KcgidReadinessEndpointPath, readinessHandler)
 	mux.Handle(internal.KcgidReadinessEndpointPath+"/", readinessHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		apis := apiMux.Load()
+		if apis == nil {
+			cgid.WriteError(w, r, http.StatusServiceUnavailable, "apiset not loaded")
+			return
+		}
+		(*apis).ServeHTTP(w, r)
+	})
 
 	server := &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context {
 		return logr.NewContext(context.Background(), log)
 	}}
-	must(server.Serve(listen), "serve http")
+	go func() {
+		err := server.Serve(listen)
+		if !errors.Is(err, http.ErrServerClosed) {
+			must(err, "serve http")
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+
+	log.Info("shutting down", "delay", delay, "gracePeriod", gracePeriod)
+	draining.Store(true)
+	time.Sleep(delay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Error(err, "in-flight requests not finished in time", "requests", inflight.Len())
+		server.Close()
+	}
+	// includes those finished but not yet released
+	inflight.ReleaseAll(context.Background(), log, dynamicClient)
+	log.Info("shut down")
 }
@@ -0,0 +1,142 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+)
+
+const (
+	expiresKey   = "expires"
+	signatureKey = "signature"
+)
+
+// Artifacts serves stored artifacts via signed URLs
+type Artifacts struct {
+	Store Store
+	// Key to sign URLs with, shared across instances
+	Key    []byte
+	Expiry time.Duration
+	// Path of the download endpoint, with trailing slash
+	Prefix string
+}
+
+type ListResponse struct {
+	Files []File `json:"files"`
+}
+
+type File struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func (a *Artifacts) signature(id string, expires string) []byte {
+	return hmacSHA256(a.Key, id+"\n"+expires)
+}
+
+func (a *Artifacts) query(id string) string {
+	expires := strconv.FormatInt(time.Now().Add(a.Expiry).Unix(), 10)
+	return url.Values{
+		expiresKey:   {expires},
+		signatureKey: {hex.EncodeToString(a.signature(id, expires))},
+	}.Encode()
+}
+
+func (a *Artifacts) verify(id string, query url.Values) bool {
+	expires := query.Get(expiresKey)
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > t {
+		return false
+	}
+	signature, err := hex.DecodeString(query.Get(signatureKey))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(signature, a.signature(id, expires))
+}
+
+// Signed URL of the listing of artifacts with id
+func (a *Artifacts) URL(id string) string {
+	return a.Prefix + url.PathEscape(id) + "/?" + a.query(id)
+}
+
+// Pattern to register on net/http.ServeMux, with method not to conflict
+// with APIs of methods
+func (a *Artifacts) Pattern() string {
+	return http.MethodGet + " " + a.Prefix + "{id}/{file...}"
+}
+
+func (a *Artifacts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logr.FromContextOrDiscard(r.Context())
+	id, file := r.PathValue("id"), r.PathValue("file")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		cgid.WriteError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !a.verify(id, r.URL.Query()) {
+		cgid.WriteError(w, r, http.StatusForbidden, "")
+		return
+	}
+
+	if file == "" {
+		names, err := a.Store.List(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			cgid.WriteError(w, r, http.StatusNotFound, "")
+			return
+		} else if err != nil {
+			log.Error(err, "cannot list artifacts", "id", id)
+			cgid.WriteError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+
+		res := ListResponse{Files: make([]File, len(names))}
+		for i, name := range names {
+			res.Files[i] = File{
+				Name: name,
+				URL:  a.Prefix + url.PathEscape(id) + "/" + (&url.URL{Path: name}).EscapedPath() + "?" + r.URL.RawQuery,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	f, err := a.Store.Open(r.Context(), path.Join(id, file))
+	if errors.Is(err, ErrNotFound) {
+		cgid.WriteError(w, r, http.StatusNotFound, "")
+		return
+	} else if err != nil {
+		log.Error(err, "cannot open artifact", "id", id, "file", file)
+		cgid.WriteError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	defer f.Close()
+
+	if t := mime.TypeByExtension(path.Ext(file)); t != "" {
+		w.Header().Set("Content-Type", t)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Error(err, "cannot send artifact", "id", id, "file", file)
+	}
+}
@@ -0,0 +1,76 @@
+package artifacts_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xdavidwu/kube-cgi/internal/cgid/artifacts"
+)
+
+func TestSignedDownload(t *testing.T) {
+	store := artifacts.Directory(t.TempDir())
+	err := store.Put(context.Background(), "pod/out/result.txt", strings.NewReader("1337"), 4)
+	if err != nil {
+		t.Fatalf("cannot put artifact: %v", err)
+	}
+
+	a := &artifacts.Artifacts{
+		Store:  store,
+		Key:    []byte("key"),
+		Expiry: time.Minute,
+		Prefix: "/artifacts/",
+	}
+	mux := &http.ServeMux{}
+	mux.Handle(a.Pattern(), a)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, httptest.NewRequest("GET", url, nil))
+		return response
+	}
+
+	response := get(a.URL("pod"))
+	if response.Code != http.StatusOK {
+		t.Fatalf("cannot list artifacts, got %v", response.Code)
+	}
+	var list artifacts.ListResponse
+	err = json.Unmarshal(response.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatalf("cannot decode listing: %v", err)
+	}
+	if len(list.Files) != 1 || list.Files[0].Name != "out/result.txt" {
+		t.Fatalf("unexpected listing: %v", list)
+	}
+
+	response = get(list.Files[0].URL)
+	if response.Code != http.StatusOK || response.Body.String() != "1337" {
+		t.Fatalf("cannot download artifact, got %v: %v", response.Code, response.Body.String())
+	}
+
+	tampered := list.Files[0].URL[:len(list.Files[0].URL)-1] + "0"
+	if tampered == list.Files[0].URL {
+		tampered = tampered[:len(tampered)-1] + "1"
+	}
+	for _, i := range []struct {
+		url  string
+		name string
+	}{
+		{strings.Replace(list.Files[0].URL, "pod", "other", 1), "other id"},
+		{"/artifacts/pod/out/result.txt", "unsigned"},
+		{tampered, "tampered"},
+	} {
+		if code := get(i.url).Code; code != http.StatusForbidden {
+			t.Fatalf("%v url not rejected, got %v", i.name, code)
+		}
+	}
+
+	a.Expiry = -time.Minute
+	if code := get(a.URL("pod")).Code; code != http.StatusForbidden {
+		t.Fatalf("expired url not rejected, got %v", code)
+	}
+}
@@ -31,7 +31,8 @@ func VarsFromRequest(r *http.Request) map[string]string {
 
 	addr, port, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		panic(err)
+		// e.g. unix sockets, without ports
+		addr, port = r.RemoteAddr, ""
 	}
 
 	res["REMOTE_ADDR"] = addr
@@ -2,6 +2,7 @@ package cgi
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,13 +11,18 @@ import (
 	"strings"
 )
 
+var (
+	ErrLengthMismatch = errors.New("body length does not match content-length")
+	ErrNoHeaders      = errors.New("cannot read headers")
+)
+
 func WriteResponse(w http.ResponseWriter, r io.Reader) (string, error) {
 	lines := bufio.NewReader(r)
 	tp := textproto.NewReader(lines)
 
 	headers, err := tp.ReadMIMEHeader()
 	if err != nil {
-		return "", fmt.Errorf("cannot read headers: %w", err)
+		return "", fmt.Errorf("%w: %w", ErrNoHeaders, err)
 	}
 
 	code := 0
@@ -43,6 +49,14 @@ func WriteResponse(w http.ResponseWriter, r io.Reader) (string, error) {
 		return location, nil
 	}
 
+	declared := int64(-1)
+	if v := h.Get("Content-Length"); v != "" {
+		declared, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || declared < 0 {
+			return "", fmt.Errorf("cannot decode content-length: %q", v)
+		}
+	}
+
 	if code == 0 {
 		if location != "" {
 			code = http.StatusFound
@@ -51,6 +65,12 @@ func WriteResponse(w http.ResponseWriter, r io.Reader) (string, error) {
 		}
 	}
 	w.WriteHeader(code)
-	_, err = io.Copy(w, lines)
+	n, err := io.Copy(w, lines)
+	if errors.Is(err, http.ErrContentLength) {
+		return "", fmt.Errorf("%w: declared %d, got more", ErrLengthMismatch, declared)
+	}
+	if err == nil && declared != -1 && n != declared {
+		return "", fmt.Errorf("%w: declared %d, got %d", ErrLengthMismatch, declared, n)
+	}
 	return "", err
 }
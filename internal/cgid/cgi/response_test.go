@@ -1,6 +1,7 @@
 package cgi_test
 
 import (
+	"errors"
 	"net/http"
 	gocgi "net/http/cgi"
 	"net/http/httptest"
@@ -54,3 +55,22 @@ func TestResponseGoCompatibility(t *testing.T) {
 		}
 	}
 }
+
+func TestResponseLengthMismatch(t *testing.T) {
+	for _, i := range []struct {
+		response string
+		mismatch bool
+		name     string
+	}{
+		{"Content-Length: 4\r\n\r\n\x00\xff\r\n", false, "exact binary body"},
+		{"Content-Length: 8\r\n\r\n1337", true, "short body"},
+		{"Content-Length: 2\r\n\r\n1337", true, "long body"},
+		{"\r\n1337", false, "no content-length"},
+	} {
+		response := httptest.NewRecorder()
+		_, err := cgi.WriteResponse(response, strings.NewReader(i.response))
+		if mismatch := errors.Is(err, cgi.ErrLengthMismatch); mismatch != i.mismatch {
+			t.Fatalf("%v: expected mismatch %v, got error %v", i.name, i.mismatch, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package cgid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// classes of errors, as exposed in metrics
+const (
+	ClassRequest   = "request"
+	ClassDispatch  = "dispatch"
+	ClassScript    = "script"
+	ClassConflict  = "conflict"
+	ClassQuota     = "quota"
+	ClassForbidden = "forbidden"
+	ClassThrottled = "throttled"
+	ClassTimeout   = "timeout"
+	ClassAPIServer = "apiserver"
+	ClassInvalid   = "invalid"
+	ClassCanceled  = "canceled"
+	ClassInternal  = "internal"
+)
+
+// as nginx, for requests closed by clients
+const StatusClientClosedRequest = 499
+
+// Error is an error to be responded with status and message, while the
+// underlying error is kept for logging
+type Error struct {
+	Status  int
+	Class   string
+	Message string
+	Err     error
+
+	// broken out, e.g. JSON schema validation errors
+	Details []Detail
+}
+
+// Detail of an error at a location of the request body, as output units of
+// JSON Schema specification
+type Detail struct {
+	// JSON Pointers
+	InstanceLocation string `json:"instanceLocation"`
+	KeywordLocation  string `json:"keywordLocation,omitempty"`
+
+	Message string   `json:"message,omitempty"`
+	Errors  []Detail `json:"errors,omitempty"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = strings.ToLower(http.StatusText(e.Status))
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", msg, e.Err.Error())
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FromKubernetes maps errors of Kubernetes API calls to statuses, with
+// details of the cluster left out of messages
+func FromKubernetes(err error) *Error {
+	if e := (*Error)(nil); errors.As(err, &e) {
+		return e
+	}
+
+	e := &Error{Err: err}
+	switch {
+	case errors.Is(err, context.Canceled):
+		e.Status, e.Class = StatusClientClosedRequest, ClassCanceled
+	case errors.Is(err, context.DeadlineExceeded),
+		apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		e.Status, e.Class = http.StatusGatewayTimeout, ClassTimeout
+	case apierrors.IsAlreadyExists(err), apierrors.IsConflict(err):
+		e.Status, e.Class = http.StatusConflict, ClassConflict
+	// k8s.io/apiserver/pkg/admission/plugin/resourcequota
+	case apierrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota"):
+		e.Status, e.Class = http.StatusTooManyRequests, ClassQuota
+		e.Message = "resource quota exceeded"
+	case apierrors.IsForbidden(err):
+		e.Status, e.Class = http.StatusBadGateway, ClassForbidden
+	case apierrors.IsTooManyRequests(err):
+		e.Status, e.Class = http.StatusTooManyRequests, ClassThrottled
+	case apierrors.IsServiceUnavailable(err), apierrors.IsInternalError(err),
+		apierrors.IsUnexpectedServerError(err):
+		e.Status, e.Class = http.StatusBadGateway, ClassAPIServer
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		e.Status, e.Class = http.StatusInternalServerError, ClassInvalid
+	default:
+		e.Status, e.Class = http.StatusInternalServerError, ClassInternal
+	}
+	return e
+}
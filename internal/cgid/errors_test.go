@@ -0,0 +1,97 @@
+package cgid_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+)
+
+func TestFromKubernetes(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	cases := []struct {
+		err    error
+		status int
+		class  string
+	}{
+		{apierrors.NewAlreadyExists(pods, "a"), http.StatusConflict, cgid.ClassConflict},
+		{apierrors.NewConflict(pods, "a", errors.New("modified")), http.StatusConflict, cgid.ClassConflict},
+		{
+			apierrors.NewForbidden(pods, "a", errors.New("exceeded quota: compute, requested: pods=1, used: pods=1, limited: pods=1")),
+			http.StatusTooManyRequests, cgid.ClassQuota,
+		},
+		{apierrors.NewForbidden(pods, "a", errors.New("rbac")), http.StatusBadGateway, cgid.ClassForbidden},
+		{apierrors.NewTooManyRequests("throttled", 1), http.StatusTooManyRequests, cgid.ClassThrottled},
+		{apierrors.NewTimeoutError("timeout", 1), http.StatusGatewayTimeout, cgid.ClassTimeout},
+		{apierrors.NewServerTimeout(pods, "create", 1), http.StatusGatewayTimeout, cgid.ClassTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, cgid.ClassTimeout},
+		{apierrors.NewServiceUnavailable("unavailable"), http.StatusBadGateway, cgid.ClassAPIServer},
+		{apierrors.NewInternalError(errors.New("etcd")), http.StatusBadGateway, cgid.ClassAPIServer},
+		{apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, "a", nil), http.StatusInternalServerError, cgid.ClassInvalid},
+		{context.Canceled, cgid.StatusClientClosedRequest, cgid.ClassCanceled},
+		{errors.New("unknown"), http.StatusInternalServerError, cgid.ClassInternal},
+	}
+
+	for _, c := range cases {
+		// as wrapped by callers
+		err := fmt.Errorf("cannot create pod: %w", c.err)
+		e := cgid.FromKubernetes(err)
+		if e.Status != c.status || e.Class != c.class {
+			t.Errorf("%v: expected %d %s, got %d %s", c.err, c.status, c.class, e.Status, e.Class)
+		}
+		if !errors.Is(e, c.err) {
+			t.Errorf("%v: underlying error not kept", c.err)
+		}
+	}
+
+	typed := &cgid.Error{Status: http.StatusBadGateway, Class: cgid.ClassScript}
+	if cgid.FromKubernetes(fmt.Errorf("wrapped: %w", typed)) != typed {
+		t.Errorf("typed error not passed through")
+	}
+}
+
+func TestWriteErrorFrom(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(cgid.ContextWithId(r.Context(), "abcde"))
+	w := httptest.NewRecorder()
+
+	err := apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "a",
+		errors.New("exceeded quota: compute"))
+	cgid.WriteErrorFrom(w, r, fmt.Errorf("cannot create pod: %w", err))
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	var body cgid.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("cannot decode body: %v", err)
+	}
+	if body.RequestID != "abcde" {
+		t.Errorf("expected request id abcde, got %q", body.RequestID)
+	}
+	if body.Message != "resource quota exceeded" {
+		t.Errorf("unexpected message %q", body.Message)
+	}
+}
+
+func TestWriteErrorWithoutId(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	cgid.WriteError(w, r, http.StatusServiceUnavailable, "")
+
+	var body cgid.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("cannot decode body: %v", err)
+	}
+	if body.RequestID != "" || body.Message != "service unavailable" {
+		t.Errorf("unexpected body %+v", body)
+	}
+}
@@ -0,0 +1,258 @@
+package kubernetes
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/artifacts"
+)
+
+//+kubebuilder:rbac:groups="",resources=pods/exec,verbs=create
+
+const (
+	artifactsName = "kcgid-artifacts"
+	// on sidecar, signals its termination
+	artifactsCollectedPath = "/tmp/.kcgid-collected"
+)
+
+func NewArtifacts(
+	ctx context.Context,
+	informers *Informers,
+	spec *kubecgiv1alpha1.ArtifactStorage,
+) (*artifacts.Artifacts, error) {
+	// watched for reloading on changes
+	secretValue := func(ref *kubecgiv1alpha1.SecretKeyRef) ([]byte, error) {
+		get, err := informers.SecretValue(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		return get()
+	}
+	key, err := secretValue(&spec.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	expiry := spec.URLExpiry
+	if expiry == 0 {
+		expiry = 3600
+	}
+
+	a := &artifacts.Artifacts{
+		Key:    key,
+		Expiry: time.Duration(expiry) * time.Second,
+		Prefix: internal.KcgidArtifactsEndpointPath,
+	}
+
+	switch {
+	case spec.PersistentVolumeClaim != nil:
+		a.Store = artifacts.Directory(internal.KcgidArtifactsMountPath)
+	case spec.S3 != nil:
+		endpoint, err := url.Parse(spec.S3.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse s3 endpoint: %w", err)
+		}
+		accessKeyID, err := secretValue(&spec.S3.AccessKeyID)
+		if err != nil {
+			return nil, err
+		}
+		secretAccessKey, err := secretValue(&spec.S3.SecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+		region := spec.S3.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		a.Store = &artifacts.S3{
+			Endpoint:        endpoint,
+			Bucket:          spec.S3.Bucket,
+			Region:          region,
+			AccessKeyID:     string(accessKeyID),
+			SecretAccessKey: string(secretAccessKey),
+		}
+	default:
+		return nil, errors.New("no artifact storage backend specified")
+	}
+	return a, nil
+}
+
+func addArtifactsSidecar(pod *corev1.Pod, spec *kubecgiv1alpha1.Artifacts) {
+	image := spec.Image
+	if image == "" {
+		image = "busybox:stable"
+	}
+	mount := corev1.VolumeMount{
+		Name:      artifactsName,
+		MountPath: spec.Path,
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: artifactsName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, mount)
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name:  artifactsName,
+		Image: image,
+		Command: []string{"sh", "-c",
+			"trap 'exit 0' TERM; until [ -e " + artifactsCollectedPath + " ]; do sleep 1; done"},
+		VolumeMounts: []corev1.VolumeMount{mount},
+	})
+}
+
+func (h kHandler) exec(name, container string, command []string) (remotecommand.Executor, error) {
+	url := h.OldClient.CoreV1().RESTClient().Post().
+		Namespace(h.Namespace).Resource("pods").
+		Name(name).SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     false,
+			Stdout:    true,
+			Stderr:    false,
+			TTY:       false,
+		}, scheme.ParameterCodec).URL()
+	return remotecommand.NewSPDYExecutor(h.ClientConfig, "POST", url)
+}
+
+func (h kHandler) storeArtifacts(ctx context.Context, name, id string, spec *kubecgiv1alpha1.Artifacts) error {
+	tarball, err := h.exec(name, artifactsName, []string{"tar", "-c", "-C", spec.Path, "."})
+	if err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(tarball.StreamWithContext(ctx, remotecommand.StreamOptions{
+			Stdout: w,
+		}))
+	}()
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot read tarball: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		key, err := artifacts.CleanKey(hdr.Name)
+		if err != nil {
+			return err
+		}
+		err = h.Artifacts.Store.Put(ctx, path.Join(id, key), tr, hdr.Size)
+		if err != nil {
+			return fmt.Errorf("cannot store %s: %w", key, err)
+		}
+	}
+}
+
+func (h kHandler) terminateSidecar(ctx context.Context, name string) error {
+	touch, err := h.exec(name, artifactsName, []string{"touch", artifactsCollectedPath})
+	if err != nil {
+		return err
+	}
+	return touch.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: io.Discard,
+	})
+}
+
+// collects artifacts of pod name, stored under id
+func (h kHandler) collectArtifacts(ctx context.Context, name, id string, spec *kubecgiv1alpha1.Artifacts) error {
+	err := h.storeArtifacts(ctx, name, id, spec)
+	// terminates sidecar regardless
+	return errors.Join(err, h.terminateSidecar(ctx, name))
+}
+
+func sidecarRunning(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.Name == artifactsName {
+			return c.State.Running != nil
+		}
+	}
+	return false
+}
+
+// lets sidecars of pods of obj terminate, other than the one collected from,
+// as pods may never be followed, e.g. after the client went away, or be of
+// failed attempts, otherwise staying running forever. Sidecars not yet
+// started are waited for, until obj is finished or deleted.
+func (h kHandler) terminateSidecars(log logr.Logger, obj client.Object, collected string) {
+	var topics []string
+	switch obj.(type) {
+	case *corev1.Pod:
+		topics = []string{podTopic(obj.GetName())}
+	case *batchv1.Job:
+		topics = []string{jobTopic(obj.GetName()), podsOfTopic(obj.GetUID())}
+	}
+	notified, unsubscribe := h.Informers.notifier.subscribe(topics...)
+	defer unsubscribe()
+
+	terminated := map[string]bool{collected: true}
+	observed := false
+	for {
+		var pods []*corev1.Pod
+		finished := false
+		switch obj.(type) {
+		case *corev1.Pod:
+			current, ok := h.Informers.pod(obj.GetName())
+			if ok {
+				observed = true
+				pods = []*corev1.Pod{current}
+				finished = current.Status.Phase == corev1.PodSucceeded ||
+					current.Status.Phase == corev1.PodFailed
+			} else if observed {
+				return
+			}
+		case *batchv1.Job:
+			current, ok := h.Informers.job(obj.GetName())
+			if ok {
+				observed = true
+				pods = h.Informers.podsOf(obj.GetUID())
+				finished = jobFinished(current) != nil
+			} else if observed {
+				return
+			}
+		}
+
+		for _, pod := range pods {
+			if terminated[pod.ObjectMeta.Name] || !sidecarRunning(pod) {
+				continue
+			}
+			terminated[pod.ObjectMeta.Name] = true
+			err := h.terminateSidecar(context.Background(), pod.ObjectMeta.Name)
+			if err != nil {
+				log.Error(err, "cannot terminate sidecar", "pod", pod.ObjectMeta.Name)
+			}
+		}
+		if finished {
+			return
+		}
+		if _, ok := obj.(*corev1.Pod); ok && terminated[obj.GetName()] {
+			return
+		}
+
+		<-notified
+	}
+}
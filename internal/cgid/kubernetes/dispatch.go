@@ -0,0 +1,147 @@
+package kubernetes
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+)
+
+var (
+	imagePullFailures = []string{
+		"ErrImagePull",
+		"ImagePullBackOff",
+		"InvalidImageName",
+		"ErrImageNeverPull",
+	}
+	// warning events from scheduler or kubelet that may precede pod status
+	disruptionEvents = []string{"Evicted", "Preempted", "Preempting"}
+)
+
+// records latest warning events of an object
+type eventRecorder struct {
+	mu       sync.Mutex
+	warnings map[string]string
+}
+
+func (r *eventRecorder) record(event *corev1.Event) {
+	if r == nil || event.Type != corev1.EventTypeWarning {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.warnings == nil {
+		r.warnings = map[string]string{}
+	}
+	r.warnings[event.Reason] = event.Message
+}
+
+// returns the first of reasons recorded, with its latest message
+func (r *eventRecorder) warning(reasons ...string) (string, string) {
+	if r == nil {
+		return "", ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reason := range reasons {
+		if message, ok := r.warnings[reason]; ok {
+			return reason, message
+		}
+	}
+	return "", ""
+}
+
+func podScheduled(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// latest reason of pod not being scheduled
+func schedulingFailure(pod *corev1.Pod, events *eventRecorder) string {
+	if _, message := events.warning("FailedScheduling"); message != "" {
+		return message
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status != corev1.ConditionTrue && c.Message != "" {
+			return c.Message
+		}
+	}
+	return "not scheduled in time"
+}
+
+// coarse progress of a pod for clients
+func progressPhase(pod *corev1.Pod) string {
+	if containerStarted(pod) || pod.Status.Phase == corev1.PodSucceeded ||
+		pod.Status.Phase == corev1.PodFailed {
+		return "Running"
+	} else if !podScheduled(pod) {
+		return "Scheduling"
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodInitialized && c.Status != corev1.ConditionTrue {
+			return "Initializing"
+		}
+	}
+	// including pulling images
+	return "Creating"
+}
+
+// sends 103 Early Hints on phase transitions
+type progressHinter struct {
+	w     http.ResponseWriter
+	last  string
+	hints bool
+}
+
+func newProgressHinter(w http.ResponseWriter, r *http.Request, enabled bool) *progressHinter {
+	// 1xx responses are undefined for HTTP/1.0
+	return &progressHinter{w: w, hints: enabled && r.ProtoAtLeast(1, 1)}
+}
+
+func (p *progressHinter) observe(pod *corev1.Pod) {
+	if p == nil || !p.hints {
+		return
+	}
+	phase := progressPhase(pod)
+	if phase == p.last {
+		return
+	}
+	p.last = phase
+
+	header := p.w.Header()
+	header.Set(cgid.PhaseHeader, phase)
+	p.w.WriteHeader(http.StatusEarlyHints)
+	// kept for final response otherwise
+	header.Del(cgid.PhaseHeader)
+}
+
+// classifies failures of a pod not caused by the script, thus worth retrying
+// with a fresh pod, returns empty string if not
+func dispatchFailure(pod *corev1.Pod, events *eventRecorder) string {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.DisruptionTarget && c.Status == corev1.ConditionTrue {
+			return c.Reason
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed && pod.Status.Reason != "" {
+		// Evicted, OutOfcpu, NodeAffinity, etc. from kubelet
+		return pod.Status.Reason
+	}
+	for _, s := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+		if s.State.Waiting != nil && slices.Contains(imagePullFailures, s.State.Waiting.Reason) {
+			return s.State.Waiting.Reason
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed {
+		reason, _ := events.warning(disruptionEvents...)
+		return reason
+	}
+	return ""
+}
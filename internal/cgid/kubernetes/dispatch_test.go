@@ -0,0 +1,129 @@
+package kubernetes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+)
+
+func TestDispatchFailure(t *testing.T) {
+	events := &eventRecorder{}
+	for _, c := range []struct {
+		name     string
+		status   corev1.PodStatus
+		expected string
+	}{
+		{"pending", corev1.PodStatus{Phase: corev1.PodPending}, ""},
+		{"failed by script", corev1.PodStatus{Phase: corev1.PodFailed}, ""},
+		{"evicted", corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted"}, "Evicted"},
+		{"preempted", corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{
+				Type:   corev1.DisruptionTarget,
+				Status: corev1.ConditionTrue,
+				Reason: "PreemptionByScheduler",
+			}},
+		}, "PreemptionByScheduler"},
+		{"image pull", corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"},
+				},
+			}},
+		}, "ImagePullBackOff"},
+	} {
+		actual := dispatchFailure(&corev1.Pod{Status: c.status}, events)
+		if actual != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, actual)
+		}
+	}
+
+	events.record(&corev1.Event{Type: corev1.EventTypeWarning, Reason: "Preempted", Message: "by other pod"})
+	failed := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodFailed}}
+	if actual := dispatchFailure(failed, events); actual != "Preempted" {
+		t.Errorf("expected failure from events, got %q", actual)
+	}
+}
+
+func TestSchedulingFailure(t *testing.T) {
+	pod := &corev1.Pod{Status: corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{{
+			Type:    corev1.PodScheduled,
+			Status:  corev1.ConditionFalse,
+			Reason:  corev1.PodReasonUnschedulable,
+			Message: "0/1 nodes are available",
+		}},
+	}}
+	events := &eventRecorder{}
+	if podScheduled(pod) {
+		t.Errorf("unschedulable pod considered scheduled")
+	}
+	if actual := schedulingFailure(pod, events); actual != "0/1 nodes are available" {
+		t.Errorf("expected reason from condition, got %q", actual)
+	}
+	events.record(&corev1.Event{
+		Type:    corev1.EventTypeWarning,
+		Reason:  "FailedScheduling",
+		Message: "0/1 nodes are available: 1 Insufficient nvidia.com/gpu.",
+	})
+	if actual := schedulingFailure(pod, events); actual != "0/1 nodes are available: 1 Insufficient nvidia.com/gpu." {
+		t.Errorf("expected reason from events, got %q", actual)
+	}
+}
+
+type hintsRecorder struct {
+	header http.Header
+	hints  []string
+}
+
+func (r *hintsRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *hintsRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (r *hintsRecorder) WriteHeader(code int) {
+	if code == http.StatusEarlyHints {
+		r.hints = append(r.hints, r.header.Get(cgid.PhaseHeader))
+	}
+}
+
+func TestProgressHints(t *testing.T) {
+	w := &hintsRecorder{header: http.Header{}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	progress := newProgressHinter(w, r, true)
+
+	pod := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodPending}}
+	progress.observe(pod)
+	progress.observe(pod)
+	pod.Status.Conditions = []corev1.PodCondition{
+		{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+	}
+	progress.observe(pod)
+	pod.Status.Phase = corev1.PodSucceeded
+	progress.observe(pod)
+
+	expected := []string{"Scheduling", "Creating", "Running"}
+	if !slices.Equal(w.hints, expected) {
+		t.Errorf("expected hints %v, got %v", expected, w.hints)
+	}
+	if w.header.Get(cgid.PhaseHeader) != "" {
+		t.Errorf("phase header leaked to final response")
+	}
+
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.0", 1, 0
+	w = &hintsRecorder{header: http.Header{}}
+	newProgressHinter(w, r, true).observe(pod)
+	if len(w.hints) != 0 {
+		t.Errorf("hints sent to HTTP/1.0 client")
+	}
+}
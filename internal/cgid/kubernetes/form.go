@@ -0,0 +1,210 @@
+package kubernetes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+)
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=create
+
+const (
+	formSecretVolumeName = "kcgid-form-secret"
+	formClaimVolumeName  = "kcgid-form-claim"
+
+	// k8s.io/kubernetes/pkg/apis/core/validation.MaxSecretSize, with some
+	// room for keys
+	formSecretMaxSize = 1024*1024 - 4096
+)
+
+var (
+	errFormTooLarge = errors.New("form too large")
+)
+
+type form struct {
+	env    []corev1.EnvVar
+	mounts []corev1.VolumeMount
+	secret map[string][]byte
+	// directory on claim to clean up, relative to kcgid mount
+	claimDir string
+}
+
+func formEnvName(field string) string {
+	return cgid.FormEnvPrefix + strings.Map(func(i rune) rune {
+		if (i >= 'A' && i <= 'Z') || (i >= '0' && i <= '9') {
+			return i
+		}
+		return '_'
+	}, strings.ToUpper(field))
+}
+
+func formFileName(name string) string {
+	name = strings.TrimLeft(path.Base(strings.ReplaceAll(name, "\\", "/")), ".")
+	if name == "" || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+func formClaimMountPath(claimName string) string {
+	return path.Join(internal.KcgidFormsMountPath, claimName)
+}
+
+// reads the whole form, placing files in memory or on claim
+func readForm(r *multipart.Reader, id string, spec *kubecgiv1alpha1.Form) (*form, error) {
+	f := &form{secret: map[string][]byte{}}
+	mountPath := spec.MountPath
+	if mountPath == "" {
+		mountPath = "/form"
+	}
+
+	values := map[string][]string{}
+	order := []string{}
+	secretSize := 0
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return f, fmt.Errorf("cannot read form: %w", err)
+		}
+
+		field := part.FormName()
+		if field == "" {
+			continue
+		}
+		name := formEnvName(field)
+		if part.FileName() == "" {
+			// read one more byte to tell if it fits
+			v, err := io.ReadAll(io.LimitReader(part, int64(cgid.MaxArgStrlen+1)))
+			if err != nil {
+				return f, fmt.Errorf("cannot read form: %w", err)
+			}
+			if len(v) > cgid.MaxArgStrlen {
+				return f, errFormTooLarge
+			}
+			if _, ok := values[name]; !ok {
+				order = append(order, name)
+			}
+			values[name] = append(values[name], string(v))
+			continue
+		}
+
+		fieldDir := path.Join(mountPath, strings.ToLower(strings.TrimPrefix(name, cgid.FormEnvPrefix)))
+		filePath := path.Join(fieldDir, formFileName(part.FileName()))
+		for _, m := range f.mounts {
+			if m.MountPath == filePath {
+				filePath = path.Join(fieldDir, strconv.Itoa(len(f.mounts))+"-"+formFileName(part.FileName()))
+				break
+			}
+		}
+
+		// read one more byte to tell if it fits
+		budget := formSecretMaxSize - secretSize
+		buf := &bytes.Buffer{}
+		_, err = io.Copy(buf, io.LimitReader(part, int64(budget+1)))
+		if err != nil {
+			return f, fmt.Errorf("cannot read form: %w", err)
+		}
+
+		if buf.Len() <= budget {
+			key := "file-" + strconv.Itoa(len(f.mounts))
+			f.secret[key] = buf.Bytes()
+			secretSize += buf.Len()
+			f.mounts = append(f.mounts, corev1.VolumeMount{
+				Name:      formSecretVolumeName,
+				MountPath: filePath,
+				SubPath:   key,
+				ReadOnly:  true,
+			})
+		} else {
+			if spec.PersistentVolumeClaim == nil {
+				return f, errFormTooLarge
+			}
+			f.claimDir = id
+			rel := path.Join(id, strings.TrimPrefix(filePath, mountPath))
+			local := filepath.Join(formClaimMountPath(spec.PersistentVolumeClaim.ClaimName), filepath.FromSlash(rel))
+			err = writeFile(local, io.MultiReader(buf, part))
+			if err != nil {
+				return f, err
+			}
+			f.mounts = append(f.mounts, corev1.VolumeMount{
+				Name:      formClaimVolumeName,
+				MountPath: filePath,
+				SubPath:   rel,
+				ReadOnly:  true,
+			})
+		}
+		if _, ok := values[name]; !ok {
+			order = append(order, name)
+		}
+		values[name] = append(values[name], filePath)
+	}
+
+	for _, name := range order {
+		f.env = append(f.env, corev1.EnvVar{
+			Name:  name,
+			Value: strings.Join(values[name], ", "),
+		})
+	}
+	return f, nil
+}
+
+func writeFile(p string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	file, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	_, err = io.Copy(file, r)
+	return errors.Join(err, file.Close())
+}
+
+func (f *form) cleanup(spec *kubecgiv1alpha1.Form) error {
+	if f.claimDir == "" {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(formClaimMountPath(spec.PersistentVolumeClaim.ClaimName), f.claimDir))
+}
+
+func (f *form) volumes(secretName string, spec *kubecgiv1alpha1.Form) []corev1.Volume {
+	volumes := []corev1.Volume{}
+	if len(f.secret) != 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: formSecretVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: secretName,
+				},
+			},
+		})
+	}
+	if f.claimDir != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name: formClaimVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: spec.PersistentVolumeClaim.ClaimName,
+					ReadOnly:  true,
+				},
+			},
+		})
+	}
+	return volumes
+}
@@ -0,0 +1,73 @@
+package kubernetes
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+)
+
+func buildForm(t *testing.T, fileSize int) *multipart.Reader {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("user-name", "xdavidwu")
+	fw, err := w.CreateFormFile("image", "../cat.png")
+	if err != nil {
+		t.Fatalf("cannot build form: %v", err)
+	}
+	fw.Write(bytes.Repeat([]byte{0xff}, fileSize))
+	w.Close()
+	return multipart.NewReader(body, w.Boundary())
+}
+
+func TestReadForm(t *testing.T) {
+	spec := &kubecgiv1alpha1.Form{MountPath: "/form"}
+	f, err := readForm(buildForm(t, 1337), "pod", spec)
+	if err != nil {
+		t.Fatalf("cannot read form: %v", err)
+	}
+
+	env := map[string]string{}
+	for _, e := range f.env {
+		env[e.Name] = e.Value
+	}
+	for _, i := range []struct {
+		value any
+		truth any
+		name  string
+	}{
+		{env["FORM_USER_NAME"], "xdavidwu", "field value"},
+		{env["FORM_IMAGE"], "/form/image/cat.png", "file path"},
+		{len(f.mounts), 1, "mounts"},
+		{f.mounts[0].MountPath, "/form/image/cat.png", "mount path"},
+		{len(f.secret[f.mounts[0].SubPath]), 1337, "file size"},
+		{f.claimDir, "", "claim usage"},
+	} {
+		if i.value != i.truth {
+			t.Fatalf("%v does not match, expected %v, got %v", i.name, i.truth, i.value)
+		}
+	}
+
+	_, err = readForm(buildForm(t, formSecretMaxSize+1), "pod", spec)
+	if !errors.Is(err, errFormTooLarge) {
+		t.Fatalf("large file without claim not rejected, got %v", err)
+	}
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("comment", strings.Repeat("a", cgid.MaxArgStrlen+1))
+	w.Close()
+	_, err = readForm(multipart.NewReader(body, w.Boundary()), "pod", spec)
+	if !errors.Is(err, errFormTooLarge) {
+		t.Fatalf("large field value not rejected, got %v", err)
+	}
+
+	_, err = readForm(multipart.NewReader(strings.NewReader("garbage"), "boundary"), "pod", spec)
+	if err == nil || errors.Is(err, errFormTooLarge) {
+		t.Fatalf("malformed form not rejected, got %v", err)
+	}
+}
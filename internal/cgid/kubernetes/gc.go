@@ -1,49 +1,90 @@
 package kubernetes
 
 import (
-	"container/ring"
 	"context"
+	"fmt"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/watch"
-	watchtools "k8s.io/client-go/tools/watch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
 )
 
-func cleanupOldGeneration(log logr.Logger, c client.Client, current *kubecgiv1alpha1.APISet) {
-	// deletion may race with other policy or instance, thus ignoring not found
+const gcMinInterval = time.Second
 
-	var list corev1.PodList
-	err := c.List(context.Background(), &list,
-		client.InNamespace(current.Namespace),
-		client.MatchingLabels{gcKey: "true"},
-		client.MatchingLabels{managedByKey: manager})
-	if err != nil {
-		log.Error(err, "cannot list pods")
-		panic("cannot list pods")
-	}
-
-	// pending is always deleted
+// pending is always deleted
+func keepPreviousPolicy(apiset *kubecgiv1alpha1.APISet) map[corev1.PodPhase]bool {
 	keep := map[corev1.PodPhase]bool{}
-
-	if current.Spec.HistoryLimit != nil {
+	if apiset.Spec.HistoryLimit != nil {
 		for _, item := range []struct {
 			phase corev1.PodPhase
 			spec  *kubecgiv1alpha1.HistoryLimitSpec
 		}{
-			{corev1.PodSucceeded, &current.Spec.HistoryLimit.Succeeded},
-			{corev1.PodFailed, &current.Spec.HistoryLimit.Failed},
+			{corev1.PodSucceeded, &apiset.Spec.HistoryLimit.Succeeded},
+			{corev1.PodFailed, &apiset.Spec.HistoryLimit.Failed},
 		} {
 			if item.spec != nil && item.spec.KeepPreviousVersions != nil {
 				keep[item.phase] = *item.spec.KeepPreviousVersions
 			}
 		}
 	}
+	return keep
+}
+
+func lastNPolicy(apiset *kubecgiv1alpha1.APISet) map[corev1.PodPhase]int32 {
+	lastN := map[corev1.PodPhase]int32{
+		corev1.PodSucceeded: 0,
+		corev1.PodFailed:    5,
+	}
+	if apiset.Spec.HistoryLimit != nil {
+		for _, item := range []struct {
+			phase corev1.PodPhase
+			spec  *kubecgiv1alpha1.HistoryLimitSpec
+		}{
+			{corev1.PodSucceeded, &apiset.Spec.HistoryLimit.Succeeded},
+			{corev1.PodFailed, &apiset.Spec.HistoryLimit.Failed},
+		} {
+			if item.spec != nil && item.spec.MaxCount != nil {
+				lastN[item.phase] = *item.spec.MaxCount
+			}
+		}
+	}
+	return lastN
+}
+
+// deletion may race with other policy or instance, thus ignoring not found
+func collect(log logr.Logger, c client.Client, obj client.Object) {
+	kind := "pod"
+	opts := []client.DeleteOption{}
+	if _, ok := obj.(*batchv1.Job); ok {
+		kind = "job"
+		opts = append(opts, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	}
+	err := client.IgnoreNotFound(c.Delete(context.Background(), obj, opts...))
+	if err != nil {
+		log.Error(err, "cannot delete "+kind, kind, obj.GetName())
+	}
+}
+
+// objects without apiset label, or released by other instances, may not be
+// observed by informers
+func cleanupOldGeneration(log logr.Logger, c client.Client, current *kubecgiv1alpha1.APISet) error {
+	var list corev1.PodList
+	err := c.List(context.Background(), &list,
+		client.InNamespace(current.Namespace),
+		client.MatchingLabels{gcKey: "true"},
+		client.MatchingLabels{managedByKey: manager})
+	if err != nil {
+		return fmt.Errorf("cannot list pods: %w", err)
+	}
+
+	keep := keepPreviousPolicy(current)
 
 	for _, pod := range list.Items {
 		generation, _ := strconv.ParseInt(pod.Labels[generationKey], 10, 0)
@@ -60,168 +101,212 @@ func cleanupOldGeneration(log logr.Logger, c client.Client, current *kubecgiv1al
 		}
 		log.Info("delete terminated pod of previous generation",
 			"pod", pod.Name, "generation", generation)
-		err = client.IgnoreNotFound(c.Delete(context.Background(), &pod))
-		if err != nil {
-			log.Error(err, "cannot delete pod", "pod", pod.Name)
-		}
+		collect(log, c, &pod)
 	}
-}
 
-func deleteUnlessLastN(log logr.Logger, c client.WithWatch, n int32, listOpts ...client.ListOption) {
-	// deletion may race with other policy or instance, thus ignoring not found
-	// last n should always be available as long as the order instances see is the same
+	if !usesJobs(current) {
+		return nil
+	}
 
-	var list corev1.PodList
-	err := c.List(context.Background(), &list, listOpts...)
+	var jobs batchv1.JobList
+	err = c.List(context.Background(), &jobs,
+		client.InNamespace(current.Namespace),
+		client.MatchingLabels{gcKey: "true"},
+		client.MatchingLabels{managedByKey: manager})
 	if err != nil {
-		log.Error(err, "cannot list pods")
-		panic("cannot list pods")
+		return fmt.Errorf("cannot list jobs: %w", err)
 	}
 
-	sort.Slice(list.Items, func(i, j int) bool {
-		iTermAt := list.Items[i].Status.ContainerStatuses[0].State.Terminated.FinishedAt.Time
-		jTermAt := list.Items[j].Status.ContainerStatuses[0].State.Terminated.FinishedAt.Time
-		return iTermAt.Before(jTermAt)
-	})
-
-	l := int32(len(list.Items))
-	for i := int32(0); i < l-n; i += 1 {
-		err = client.IgnoreNotFound(c.Delete(context.Background(), &list.Items[i]))
-		if err != nil {
-			log.Error(err, "cannot delete pod", "pod", list.Items[i].Name)
+	for _, job := range jobs.Items {
+		generation, _ := strconv.ParseInt(job.Labels[generationKey], 10, 0)
+		if generation >= current.Generation {
+			continue
+		}
+		phase, finished := jobPhase(&job)
+		if !finished {
+			log.Info("found unfinished job of previous generation",
+				"job", job.Name, "generation", generation)
+			continue
 		}
+		if keep[phase] {
+			continue
+		}
+		log.Info("delete finished job of previous generation",
+			"job", job.Name, "generation", generation)
+		collect(log, c, &job)
 	}
+	return nil
+}
 
-	q := ring.New(int(n))
-	for i := max(l-n, 0); i < l; i += 1 {
-		q.Value = &list.Items[i]
-		q = q.Next()
+func usesJobs(apiset *kubecgiv1alpha1.APISet) bool {
+	for _, api := range apiset.Spec.APIs {
+		if api.Dispatch != nil && api.Dispatch.Job != nil {
+			return true
+		}
 	}
+	return false
+}
 
-	watcher, err := watchtools.NewRetryWatcher(
-		list.ResourceVersion,
-		watcherWithOpts(context.Background(), c, &list, listOpts...),
-	)
-	if err != nil {
-		log.Error(err, "cannot watch pods")
-		panic("cannot watch pods")
+// maps job outcome to phase of pod, for sharing history limits
+func jobPhase(job *batchv1.Job) (corev1.PodPhase, bool) {
+	c := jobFinished(job)
+	if c == nil {
+		return "", false
+	} else if c.Type == batchv1.JobComplete {
+		return corev1.PodSucceeded, true
 	}
-	results := watcher.ResultChan()
-	for {
-		ev, ok := <-results
-		if !ok {
-			log.Error(nil, "watch channel closed")
-			panic("watch channel closed")
-		}
-		if ev.Type == watch.Added {
-			if q == nil {
-				pod := ev.Object.(*corev1.Pod)
-				log.Info("remove pod due to maxCount", "pod", pod.Name)
-				err = client.IgnoreNotFound(c.Delete(context.Background(), pod))
-				if err != nil {
-					log.Error(err, "cannot delete pod", "pod", pod.Name)
-				}
-			} else {
-				if q.Value != nil {
-					pod := q.Value.(*corev1.Pod)
-					log.Info("remove pod due to maxCount", "pod", pod.Name)
-					err = client.IgnoreNotFound(c.Delete(context.Background(), pod))
-					if err != nil {
-						log.Error(err, "cannot delete pod", "pod", pod.Name)
-					}
-				}
-				q.Value = ev.Object.(*corev1.Pod)
-				q = q.Next()
-			}
+	return corev1.PodFailed, true
+}
+
+// main container of pods may never run, e.g. evicted
+func podFinishedAt(pod *corev1.Pod) metav1.Time {
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.Name == pod.Spec.Containers[0].Name && c.State.Terminated != nil {
+			return c.State.Terminated.FinishedAt
 		}
 	}
+	return pod.CreationTimestamp
 }
 
-func deleteAll(log logr.Logger, c client.WithWatch, listOpts ...client.ListOption) {
-	// deletion may race with other policy or instance, thus ignoring not found
-	// last n should always be available as long as the order instances see is the same
+type gcPolicy struct {
+	generation   int64
+	lastN        map[corev1.PodPhase]int32
+	keepPrevious map[corev1.PodPhase]bool
+}
 
-	var list corev1.PodList
-	err := c.List(context.Background(), &list, listOpts...)
-	if err != nil {
-		log.Error(err, "cannot list pods")
-		panic("cannot list pods")
+func gcPolicyFor(apiset *kubecgiv1alpha1.APISet) gcPolicy {
+	return gcPolicy{
+		generation:   apiset.Generation,
+		lastN:        lastNPolicy(apiset),
+		keepPrevious: keepPreviousPolicy(apiset),
 	}
+}
 
-	l := int32(len(list.Items))
-	for i := int32(0); i < l; i += 1 {
-		err = client.IgnoreNotFound(c.Delete(context.Background(), &list.Items[i]))
-		if err != nil {
-			log.Error(err, "cannot delete pod", "pod", list.Items[i].Name)
-		}
+// returns whether obj is released, and if it is from previous generations
+func released(obj metav1.Object, generation int64) (bool, bool) {
+	labels := obj.GetLabels()
+	if labels[gcKey] != "true" || obj.GetDeletionTimestamp() != nil {
+		return false, false
 	}
+	objGeneration, _ := strconv.ParseInt(labels[generationKey], 10, 0)
+	return objGeneration <= generation, objGeneration < generation
+}
 
-	watcher, err := watchtools.NewRetryWatcher(
-		list.ResourceVersion,
-		watcherWithOpts(context.Background(), c, &list, listOpts...),
-	)
-	if err != nil {
-		log.Error(err, "cannot watch pods")
-		panic("cannot watch pods")
+// last n should always be available as long as the order instances see is the same
+func exceedingLastN[T any](items []T, n int32, finishedAt func(T) metav1.Time) []T {
+	if int32(len(items)) <= n {
+		return nil
 	}
-	results := watcher.ResultChan()
-	for {
-		ev, ok := <-results
+	sort.Slice(items, func(i, j int) bool {
+		iAt, jAt := finishedAt(items[i]), finishedAt(items[j])
+		return iAt.Before(&jAt)
+	})
+	return items[:int32(len(items))-n]
+}
+
+// pods to delete under maxCount and keepPreviousVersions policies, and
+// pending ones that are orphaned
+func podsToCollect(pods []*corev1.Pod, policy gcPolicy) []*corev1.Pod {
+	collect := []*corev1.Pod{}
+	byPhase := map[corev1.PodPhase][]*corev1.Pod{}
+	for _, pod := range pods {
+		ok, previous := released(pod, policy.generation)
 		if !ok {
-			log.Error(nil, "watch channel closed")
-			panic("watch channel closed")
+			continue
 		}
-		if ev.Type == watch.Added {
-			pod := ev.Object.(*corev1.Pod)
-			log.Info("remove pod", "pod", pod.Name)
-			err = client.IgnoreNotFound(c.Delete(context.Background(), pod))
-			if err != nil {
-				log.Error(err, "cannot delete pod", "pod", pod.Name)
+		if pod.Status.Phase == corev1.PodPending {
+			collect = append(collect, pod)
+		} else if previous {
+			if pod.Status.Phase != corev1.PodRunning && !policy.keepPrevious[pod.Status.Phase] {
+				collect = append(collect, pod)
 			}
+		} else if _, ok := policy.lastN[pod.Status.Phase]; ok {
+			byPhase[pod.Status.Phase] = append(byPhase[pod.Status.Phase], pod)
 		}
+		// TODO for running pod, define a deadline for it to terminate?
 	}
+	for phase, pods := range byPhase {
+		collect = append(collect, exceedingLastN(pods, policy.lastN[phase], podFinishedAt)...)
+	}
+	return collect
 }
 
-func CollectGarbage(log logr.Logger, c client.WithWatch, apiset *kubecgiv1alpha1.APISet) {
-	cleanupOldGeneration(log.WithValues("policy", "previousVersions"), c, apiset)
+// jobs to delete under maxCount policies, sharing those of pods by outcome
+func jobsToCollect(jobs []*batchv1.Job, policy gcPolicy) []*batchv1.Job {
+	collect := []*batchv1.Job{}
+	byPhase := map[corev1.PodPhase][]*batchv1.Job{}
+	for _, job := range jobs {
+		ok, previous := released(job, policy.generation)
+		if !ok {
+			continue
+		}
+		// finishes may be observed after release
+		phase, finished := jobPhase(job)
+		if !finished {
+			continue
+		}
+		if previous {
+			if !policy.keepPrevious[phase] {
+				collect = append(collect, job)
+			}
+		} else {
+			byPhase[phase] = append(byPhase[phase], job)
+		}
+	}
+	for phase, jobs := range byPhase {
+		collect = append(collect, exceedingLastN(jobs, policy.lastN[phase], func(job *batchv1.Job) metav1.Time {
+			return jobFinished(job).LastTransitionTime
+		})...)
+	}
+	return collect
+}
 
-	lastNPolicy := map[corev1.PodPhase]int32{
-		corev1.PodSucceeded: 0,
-		corev1.PodFailed:    5,
+// CollectGarbage deletes released objects as policies of the APISet observed
+// by informers, which may change over time
+func CollectGarbage(log logr.Logger, c client.Client, informers *Informers) {
+	notified, _ := informers.notifier.subscribe(gcTopic)
+	if !informers.WaitForCacheSync(context.Background()) {
+		log.Error(nil, "cannot sync informers")
+		panic("cannot sync informers")
+	}
+	// notifications during the interval are coalesced, bounding passes
+	// under bursts of updates
+	wait := func() {
+		time.Sleep(gcMinInterval)
+		<-notified
 	}
 
-	if apiset.Spec.HistoryLimit != nil {
-		for _, item := range []struct {
-			phase corev1.PodPhase
-			spec  *kubecgiv1alpha1.HistoryLimitSpec
-		}{
-			{corev1.PodSucceeded, &apiset.Spec.HistoryLimit.Succeeded},
-			{corev1.PodFailed, &apiset.Spec.HistoryLimit.Failed},
-		} {
-			if item.spec != nil && item.spec.MaxCount != nil {
-				lastNPolicy[item.phase] = *item.spec.MaxCount
+	var policy gcPolicy
+	// of the last successful cleanup of previous generations
+	cleaned := int64(0)
+	for ; ; wait() {
+		apiset := informers.APISet()
+		if apiset == nil {
+			continue
+		}
+		if apiset.Generation != policy.generation {
+			policy = gcPolicyFor(apiset)
+			log.Info("gc policy updated", "generation", policy.generation,
+				"maxCount", policy.lastN, "keepPreviousVersions", policy.keepPrevious)
+		}
+		if apiset.Generation != cleaned {
+			// previous generations include ones not observed by informers
+			err := cleanupOldGeneration(log.WithValues("policy", "previousVersions"), c, apiset)
+			if err != nil {
+				// retried on next pass
+				log.Error(err, "cannot clean up previous generations")
+			} else {
+				cleaned = apiset.Generation
 			}
 		}
-	}
 
-	gen := strconv.FormatInt(apiset.Generation, 10)
-	for phase, n := range lastNPolicy {
-		go deleteUnlessLastN(
-			log.WithValues("for", phase, "policy", "maxCount", "maxCount", n),
-			c, n,
-			client.InNamespace(apiset.Namespace),
-			client.MatchingLabels{managedByKey: manager},
-			client.MatchingLabels{generationKey: gen},
-			client.MatchingLabels{gcKey: "true"},
-			client.MatchingFields{"status.phase": string(phase)})
-	}
-	go deleteAll(
-		log.WithValues("policy", "orphanedPending"),
-		c,
-		client.InNamespace(apiset.Namespace),
-		client.MatchingLabels{managedByKey: manager},
-		client.MatchingLabels{generationKey: gen},
-		client.MatchingLabels{gcKey: "true"},
-		client.MatchingFields{"status.phase": string(corev1.PodPending)})
-	// TODO for running pod, define a deadline for it to terminate?
+		for _, pod := range podsToCollect(informers.allPods(), policy) {
+			log.Info("remove pod", "pod", pod.Name, "phase", pod.Status.Phase)
+			collect(log, c, pod)
+		}
+		for _, job := range jobsToCollect(informers.allJobs(), policy) {
+			log.Info("remove job", "job", job.Name)
+			collect(log, c, job)
+		}
+	}
 }
@@ -0,0 +1,113 @@
+package kubernetes
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func releasedPod(name string, phase corev1.PodPhase, finishedAt time.Time) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{gcKey: "true", generationKey: "2"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "cgi"}}},
+		Status: corev1.PodStatus{
+			Phase: phase,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "cgi",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{
+						FinishedAt: metav1.NewTime(finishedAt),
+					},
+				},
+			}},
+		},
+	}
+}
+
+func names[T metav1.Object](objs []T) []string {
+	names := []string{}
+	for _, obj := range objs {
+		names = append(names, obj.GetName())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestPodsToCollect(t *testing.T) {
+	now := time.Now()
+	unreleased := releasedPod("unreleased", corev1.PodSucceeded, now)
+	delete(unreleased.Labels, gcKey)
+	previous := releasedPod("previous", corev1.PodSucceeded, now)
+	previous.Labels[generationKey] = "1"
+	previousFailed := releasedPod("previous-failed", corev1.PodFailed, now)
+	previousFailed.Labels[generationKey] = "1"
+	next := releasedPod("next", corev1.PodSucceeded, now)
+	next.Labels[generationKey] = "3"
+	pods := []*corev1.Pod{
+		releasedPod("failed-new", corev1.PodFailed, now),
+		releasedPod("failed-old", corev1.PodFailed, now.Add(-time.Hour)),
+		releasedPod("failed-mid", corev1.PodFailed, now.Add(-time.Minute)),
+		releasedPod("succeeded", corev1.PodSucceeded, now),
+		releasedPod("pending", corev1.PodPending, now),
+		releasedPod("running", corev1.PodRunning, now),
+		unreleased,
+		previous,
+		previousFailed,
+		next,
+	}
+
+	actual := names(podsToCollect(pods, gcPolicy{
+		generation: 2,
+		lastN: map[corev1.PodPhase]int32{
+			corev1.PodSucceeded: 0,
+			corev1.PodFailed:    2,
+		},
+		keepPrevious: map[corev1.PodPhase]bool{corev1.PodSucceeded: true},
+	}))
+	expected := []string{"failed-old", "pending", "previous-failed", "succeeded"}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestJobsToCollect(t *testing.T) {
+	now := time.Now()
+	job := func(name string, condition batchv1.JobConditionType, at time.Time) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{gcKey: "true", generationKey: "2"},
+			},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{
+				Type:               condition,
+				Status:             corev1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(at),
+			}}},
+		}
+	}
+	jobs := []*batchv1.Job{
+		job("complete-new", batchv1.JobComplete, now),
+		job("complete-old", batchv1.JobComplete, now.Add(-time.Hour)),
+		job("failed", batchv1.JobFailed, now),
+		job("suspended", batchv1.JobSuspended, now),
+	}
+
+	actual := names(jobsToCollect(jobs, gcPolicy{
+		generation: 2,
+		lastN: map[corev1.PodPhase]int32{
+			corev1.PodSucceeded: 1,
+			corev1.PodFailed:    0,
+		},
+	}))
+	expected := []string{"complete-old", "failed"}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
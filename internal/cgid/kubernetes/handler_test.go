@@ -0,0 +1,126 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/middlewares"
+	"github.com/xdavidwu/kube-cgi/internal/schema"
+)
+
+var benchmarkSpec = &kubecgiv1alpha1.API{
+	Path: "/bench",
+	Request: &kubecgiv1alpha1.Request{
+		Schema: &kubecgiv1alpha1.Schema{
+			RawJSON: `{"type":"object","properties":{"name":{"type":"string","maxLength":16}},"required":["name"]}`,
+		},
+		Authentication: &kubecgiv1alpha1.Authentication{
+			PreShared: &kubecgiv1alpha1.PreShared{
+				SecretKeyRef: &kubecgiv1alpha1.SecretKeyRef{Name: "token", Key: "token"},
+			},
+		},
+	},
+}
+
+func benchmarkRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/bench", strings.NewReader(`{"name":"xdavidwu"}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	return r
+}
+
+func createBenchmarkSecret(b testing.TB, c client.Client) {
+	err := c.Create(context.Background(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: benchmarkNamespace, Name: "token"},
+		Data:       map[string][]byte{"token": []byte("secret")},
+	})
+	if err != nil {
+		b.Fatalf("cannot create secret: %v", err)
+	}
+}
+
+var noContent = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+// previous approach, compiling schemas and getting secrets per request
+func BenchmarkMiddlewaresPerRequestInit(b *testing.B) {
+	var requests atomic.Int64
+	c := countingClient(b, &requests)
+	createBenchmarkSecret(b, c)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := benchmarkRequest()
+		compiled, err := schema.CompileString(benchmarkSpec.Request.Schema.RawJSON, nil)
+		if err != nil {
+			b.Fatalf("cannot compile schema: %v", err)
+		}
+		ref := benchmarkSpec.Request.Authentication.PreShared.SecretKeyRef
+		var secret corev1.Secret
+		err = c.Get(r.Context(), client.ObjectKey{Namespace: benchmarkNamespace, Name: ref.Name}, &secret)
+		// gets are not intercepted
+		requests.Add(1)
+		if err != nil {
+			b.Fatalf("cannot get secret: %v", err)
+		}
+		token := func() ([]byte, error) { return secret.Data[ref.Key], nil }
+		stack := middlewares.DrainBody(middlewares.AuthnWithPreShared(
+			middlewares.ValidateJson(noContent, compiled, benchmarkSpec.Request.ValidationOutput), token))
+
+		w := httptest.NewRecorder()
+		stack.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			b.Fatalf("unexpected status %v", w.Code)
+		}
+	}
+	b.ReportMetric(float64(requests.Load())/float64(b.N), "requests/op")
+}
+
+func BenchmarkMiddlewaresPrebuilt(b *testing.B) {
+	var requests atomic.Int64
+	c := countingClient(b, &requests)
+	createBenchmarkSecret(b, c)
+	informers := NewInformers(c, benchmarkNamespace, "apiset")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx)
+
+	h := KubernetesHandler{Namespace: benchmarkNamespace, Spec: benchmarkSpec, Informers: informers}
+	stack, err := h.middlewares(ctx, noContent)
+	if err != nil {
+		b.Fatalf("cannot build handler: %v", err)
+	}
+	requests.Store(0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		stack.ServeHTTP(w, benchmarkRequest())
+		if w.Code != http.StatusNoContent {
+			b.Fatalf("unexpected status %v", w.Code)
+		}
+	}
+	b.ReportMetric(float64(requests.Load())/float64(b.N), "requests/op")
+}
+
+func TestBuildFailsFast(t *testing.T) {
+	h := KubernetesHandler{Spec: &kubecgiv1alpha1.API{
+		Path: "/broken",
+		Request: &kubecgiv1alpha1.Request{
+			Schema: &kubecgiv1alpha1.Schema{RawJSON: `{"type":1}`},
+		},
+	}}
+	_, err := h.Build(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "/broken") {
+		t.Errorf("expected schema error of the API, got %v", err)
+	}
+}
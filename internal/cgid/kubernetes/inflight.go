@@ -0,0 +1,82 @@
+package kubernetes
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// marks the object for garbage collection
+func release(ctx context.Context, log logr.Logger, c client.Client, obj client.Object) {
+	gvk, err := c.GroupVersionKindFor(obj)
+	if err != nil {
+		log.Error(err, "cannot prepare patch")
+		return
+	}
+	u := unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	u.SetNamespace(obj.GetNamespace())
+	u.SetName(obj.GetName())
+	u.SetLabels(map[string]string{gcKey: "true"})
+	err = c.Patch(ctx, &u, client.Apply, client.ForceOwnership, client.FieldOwner(manager))
+	if err != nil {
+		log.Error(err, "cannot apply patch")
+		return
+	}
+}
+
+// Inflight tracks objects dispatched and not yet released, for releasing
+// them on shutdown
+type Inflight struct {
+	mu      sync.Mutex
+	objects map[client.Object]bool
+}
+
+func (i *Inflight) add(obj client.Object) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.objects == nil {
+		i.objects = map[client.Object]bool{}
+	}
+	i.objects[obj] = true
+}
+
+func (i *Inflight) remove(obj client.Object) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.objects, obj)
+}
+
+func (i *Inflight) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.objects)
+}
+
+// ReleaseAll releases remaining objects, as their requests will not
+func (i *Inflight) ReleaseAll(ctx context.Context, log logr.Logger, c client.Client) {
+	i.mu.Lock()
+	objects := i.objects
+	i.objects = nil
+	i.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for obj := range objects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Info("release leftover object", "name", obj.GetName())
+			release(ctx, log, c, obj)
+		}()
+	}
+	wg.Wait()
+}
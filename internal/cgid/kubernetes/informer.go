@@ -0,0 +1,451 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/schema"
+)
+
+const (
+	controllerUIDIndex  = "controller-uid"
+	involvedObjectIndex = "involved-object"
+
+	gcTopic = "gc"
+	// APISet of a new generation, or objects referred by it changed
+	reloadTopic = "reload"
+
+	reloadBackoffInitial = time.Second
+	reloadBackoffMax     = 5 * time.Minute
+)
+
+func podTopic(name string) string {
+	return "pod/" + name
+}
+
+func jobTopic(name string) string {
+	return "job/" + name
+}
+
+func podsOfTopic(uid types.UID) string {
+	return "pods-of/" + string(uid)
+}
+
+func eventsTopic(uid types.UID) string {
+	return "events/" + string(uid)
+}
+
+// wakes subscribers of topics, without carrying objects, as subscribers read
+// latest states from informer stores
+type notifier struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]bool
+}
+
+func (n *notifier) subscribe(topics ...string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subs == nil {
+		n.subs = map[string]map[chan struct{}]bool{}
+	}
+	for _, topic := range topics {
+		if n.subs[topic] == nil {
+			n.subs[topic] = map[chan struct{}]bool{}
+		}
+		n.subs[topic][ch] = true
+	}
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for _, topic := range topics {
+			delete(n.subs[topic], ch)
+			if len(n.subs[topic]) == 0 {
+				delete(n.subs, topic)
+			}
+		}
+	}
+}
+
+func (n *notifier) notify(topics ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, topic := range topics {
+		for ch := range n.subs[topic] {
+			select {
+			case ch <- struct{}{}:
+			default:
+				// already pending
+			}
+		}
+	}
+}
+
+// Informers share watches on an APISet, objects dispatched for it and their
+// events, among requests and garbage collection
+type Informers struct {
+	Namespace string
+	Name      string
+
+	apisets   cache.SharedIndexInformer
+	pods      cache.SharedIndexInformer
+	podEvents cache.SharedIndexInformer
+	jobs      cache.SharedIndexInformer
+	jobEvents cache.SharedIndexInformer
+
+	// started on demand, by resource and name
+	client     client.WithWatch
+	ctx        context.Context
+	referredMu sync.Mutex
+	referred   map[string]referredInformer
+	// by the APISet being loaded
+	referencing map[string]bool
+
+	notifier notifier
+}
+
+func NewInformers(c client.WithWatch, namespace, name string) *Informers {
+	ctx := context.Background()
+	i := &Informers{Namespace: namespace, Name: name, client: c}
+
+	i.apisets = cache.NewSharedIndexInformer(
+		watcherWithOpts(ctx, c, &kubecgiv1alpha1.APISetList{},
+			client.InNamespace(namespace),
+			client.MatchingFields{metav1.ObjectNameField: name}),
+		&kubecgiv1alpha1.APISet{},
+		0,
+		cache.Indexers{},
+	)
+	i.apisets.AddEventHandler(i.handler(func(metav1.Object) []string {
+		return []string{gcTopic}
+	}))
+	i.apisets.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(any) {
+			i.notifier.notify(reloadTopic)
+		},
+		UpdateFunc: func(oldObj, obj any) {
+			if oldObj.(*kubecgiv1alpha1.APISet).Generation != obj.(*kubecgiv1alpha1.APISet).Generation {
+				i.notifier.notify(reloadTopic)
+			}
+		},
+	})
+
+	// jobs are always watched, as APISet may change to use them
+	selector := []client.ListOption{
+		client.InNamespace(namespace),
+		client.MatchingLabels{managedByKey: manager, apisetKey: name},
+	}
+	i.pods = cache.NewSharedIndexInformer(
+		watcherWithOpts(ctx, c, &corev1.PodList{}, selector...),
+		&corev1.Pod{},
+		0,
+		cache.Indexers{controllerUIDIndex: indexByControllerUID},
+	)
+	i.pods.AddEventHandler(i.handler(func(obj metav1.Object) []string {
+		topics := []string{podTopic(obj.GetName()), gcTopic}
+		if uid, ok := obj.GetLabels()[batchv1.ControllerUidLabel]; ok {
+			topics = append(topics, podsOfTopic(types.UID(uid)))
+		}
+		return topics
+	}))
+	i.podEvents = i.eventInformer(c, "Pod")
+
+	i.jobs = cache.NewSharedIndexInformer(
+		watcherWithOpts(ctx, c, &batchv1.JobList{}, selector...),
+		&batchv1.Job{},
+		0,
+		cache.Indexers{},
+	)
+	i.jobs.AddEventHandler(i.handler(func(obj metav1.Object) []string {
+		return []string{jobTopic(obj.GetName()), gcTopic}
+	}))
+	i.jobEvents = i.eventInformer(c, "Job")
+	return i
+}
+
+// OnAPISetChange calls f with the APISet when observed with a new generation,
+// or when secrets or configmaps referred by it change. Failed calls are
+// retried with backoff, and objects no longer referred are unwatched once a
+// call succeeds. Calls are serialized.
+func (i *Informers) OnAPISetChange(f func(*kubecgiv1alpha1.APISet) error) {
+	notified, _ := i.notifier.subscribe(reloadTopic)
+	go func() {
+		backoff := reloadBackoffInitial
+		var retry <-chan time.Time
+		for {
+			select {
+			case <-notified:
+			case <-retry:
+			}
+			apiSet := i.APISet()
+			if apiSet == nil {
+				retry = nil
+				continue
+			}
+
+			i.referredMu.Lock()
+			i.referencing = map[string]bool{}
+			i.referredMu.Unlock()
+			if err := f(apiSet); err != nil {
+				retry = time.After(backoff)
+				backoff = min(backoff*2, reloadBackoffMax)
+				continue
+			}
+			retry = nil
+			backoff = reloadBackoffInitial
+			// those of a failed one are kept, as the previous one may use them
+			i.stopUnreferenced()
+		}
+	}()
+}
+
+// APISet returns the latest observed APISet, or nil if not found
+func (i *Informers) APISet() *kubecgiv1alpha1.APISet {
+	obj, ok, _ := i.apisets.GetStore().GetByKey(i.Namespace + "/" + i.Name)
+	if !ok {
+		return nil
+	}
+	return obj.(*kubecgiv1alpha1.APISet).DeepCopy()
+}
+
+func (i *Informers) eventInformer(c client.WithWatch, kind string) cache.SharedIndexInformer {
+	informer := cache.NewSharedIndexInformer(
+		watcherWithOpts(context.Background(), c, &corev1.EventList{},
+			client.InNamespace(i.Namespace),
+			// k8s.io/kubernetes/pkg/registry/core/event.ToSelectableFields
+			client.MatchingFields{"involvedObject.kind": kind},
+		),
+		&corev1.Event{},
+		0,
+		cache.Indexers{involvedObjectIndex: indexByInvolvedObject},
+	)
+	informer.AddEventHandler(i.handler(func(obj metav1.Object) []string {
+		return []string{eventsTopic(obj.(*corev1.Event).InvolvedObject.UID)}
+	}))
+	return informer
+}
+
+func (i *Informers) handler(topics func(metav1.Object) []string) cache.ResourceEventHandler {
+	notify := func(obj any) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if o, ok := obj.(metav1.Object); ok {
+			i.notifier.notify(topics(o)...)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj any) { notify(obj) },
+		DeleteFunc: notify,
+	}
+}
+
+func indexByControllerUID(obj any) ([]string, error) {
+	if uid, ok := obj.(metav1.Object).GetLabels()[batchv1.ControllerUidLabel]; ok {
+		return []string{uid}, nil
+	}
+	return nil, nil
+}
+
+func indexByInvolvedObject(obj any) ([]string, error) {
+	return []string{string(obj.(*corev1.Event).InvolvedObject.UID)}, nil
+}
+
+func (i *Informers) informers() []cache.SharedIndexInformer {
+	return []cache.SharedIndexInformer{i.apisets, i.pods, i.podEvents, i.jobs, i.jobEvents}
+}
+
+// Start runs informers until ctx is done
+func (i *Informers) Start(ctx context.Context) {
+	i.referredMu.Lock()
+	i.ctx = ctx
+	i.referredMu.Unlock()
+	for _, informer := range i.informers() {
+		go informer.Run(ctx.Done())
+	}
+}
+
+type referredInformer struct {
+	cache.SharedIndexInformer
+	stop context.CancelFunc
+}
+
+// referred objects are watched by name, as they are few
+func (i *Informers) referredInformer(resource, name string, list client.ObjectList, obj client.Object) cache.SharedIndexInformer {
+	key := resource + "/" + name
+	i.referredMu.Lock()
+	defer i.referredMu.Unlock()
+	if i.referencing != nil {
+		i.referencing[key] = true
+	}
+	if informer, ok := i.referred[key]; ok {
+		return informer
+	}
+	if i.referred == nil {
+		i.referred = map[string]referredInformer{}
+	}
+	informer := cache.NewSharedIndexInformer(
+		watcherWithOpts(context.Background(), i.client, list,
+			client.InNamespace(i.Namespace),
+			client.MatchingFields{metav1.ObjectNameField: name}),
+		obj,
+		0,
+		cache.Indexers{},
+	)
+	// initial states are already seen by the loading
+	informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(_ any, isInInitialList bool) {
+			if !isInInitialList {
+				i.notifier.notify(reloadTopic)
+			}
+		},
+		UpdateFunc: func(oldObj, obj any) {
+			if oldObj.(metav1.Object).GetResourceVersion() != obj.(metav1.Object).GetResourceVersion() {
+				i.notifier.notify(reloadTopic)
+			}
+		},
+		DeleteFunc: func(any) {
+			i.notifier.notify(reloadTopic)
+		},
+	})
+	ctx, cancel := context.WithCancel(i.ctx)
+	i.referred[key] = referredInformer{informer, cancel}
+	go informer.Run(ctx.Done())
+	return informer
+}
+
+func (i *Informers) stopUnreferenced() {
+	i.referredMu.Lock()
+	defer i.referredMu.Unlock()
+	for key, informer := range i.referred {
+		if !i.referencing[key] {
+			informer.stop()
+			delete(i.referred, key)
+		}
+	}
+	i.referencing = nil
+}
+
+// SecretValue waits for the secret to be observed, and returns a getter of
+// its latest value, failing if not found or the key is missing
+func (i *Informers) SecretValue(ctx context.Context, ref *kubecgiv1alpha1.SecretKeyRef) (func() ([]byte, error), error) {
+	informer := i.referredInformer("secrets", ref.Name, &corev1.SecretList{}, &corev1.Secret{})
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("cannot sync secret %s/%s", i.Namespace, ref.Name)
+	}
+	get := func() ([]byte, error) {
+		obj, ok, _ := informer.GetStore().GetByKey(i.Namespace + "/" + ref.Name)
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s not found", i.Namespace, ref.Name)
+		}
+		v, ok := obj.(*corev1.Secret).Data[ref.Key]
+		if !ok {
+			return nil, fmt.Errorf("referred key %s not found in secret %s/%s", ref.Key, i.Namespace, ref.Name)
+		}
+		return v, nil
+	}
+	_, err := get()
+	if err != nil {
+		return nil, err
+	}
+	return get, nil
+}
+
+// ConfigMaps gets configmaps as observed, waiting with ctx for them to be
+func (i *Informers) ConfigMaps(ctx context.Context) schema.ConfigMaps {
+	return func(name string) (map[string]string, error) {
+		informer := i.referredInformer("configmaps", name, &corev1.ConfigMapList{}, &corev1.ConfigMap{})
+		if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+			return nil, fmt.Errorf("cannot sync configmap %s/%s", i.Namespace, name)
+		}
+		obj, ok, _ := informer.GetStore().GetByKey(i.Namespace + "/" + name)
+		if !ok {
+			return nil, fmt.Errorf("configmap %s/%s not found", i.Namespace, name)
+		}
+		return obj.(*corev1.ConfigMap).Data, nil
+	}
+}
+
+func (i *Informers) HasSynced() bool {
+	for _, informer := range i.informers() {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *Informers) WaitForCacheSync(ctx context.Context) bool {
+	syncs := []cache.InformerSynced{}
+	for _, informer := range i.informers() {
+		syncs = append(syncs, informer.HasSynced)
+	}
+	return cache.WaitForCacheSync(ctx.Done(), syncs...)
+}
+
+// objects from stores are shared, thus deep copied
+
+func (i *Informers) pod(name string) (*corev1.Pod, bool) {
+	obj, ok, _ := i.pods.GetStore().GetByKey(i.Namespace + "/" + name)
+	if !ok {
+		return nil, false
+	}
+	return obj.(*corev1.Pod).DeepCopy(), true
+}
+
+func (i *Informers) job(name string) (*batchv1.Job, bool) {
+	obj, ok, _ := i.jobs.GetStore().GetByKey(i.Namespace + "/" + name)
+	if !ok {
+		return nil, false
+	}
+	return obj.(*batchv1.Job).DeepCopy(), true
+}
+
+func (i *Informers) podsOf(uid types.UID) []*corev1.Pod {
+	objs, _ := i.pods.GetIndexer().ByIndex(controllerUIDIndex, string(uid))
+	pods := make([]*corev1.Pod, len(objs))
+	for j, obj := range objs {
+		pods[j] = obj.(*corev1.Pod).DeepCopy()
+	}
+	return pods
+}
+
+func (i *Informers) allPods() []*corev1.Pod {
+	objs := i.pods.GetStore().List()
+	pods := make([]*corev1.Pod, len(objs))
+	for j, obj := range objs {
+		pods[j] = obj.(*corev1.Pod).DeepCopy()
+	}
+	return pods
+}
+
+func (i *Informers) allJobs() []*batchv1.Job {
+	objs := i.jobs.GetStore().List()
+	jobs := make([]*batchv1.Job, len(objs))
+	for j, obj := range objs {
+		jobs[j] = obj.(*batchv1.Job).DeepCopy()
+	}
+	return jobs
+}
+
+func (i *Informers) eventsFor(uid types.UID) []*corev1.Event {
+	events := []*corev1.Event{}
+	for _, informer := range []cache.SharedIndexInformer{i.podEvents, i.jobEvents} {
+		objs, _ := informer.GetIndexer().ByIndex(involvedObjectIndex, string(uid))
+		for _, obj := range objs {
+			events = append(events, obj.(*corev1.Event).DeepCopy())
+		}
+	}
+	return events
+}
@@ -0,0 +1,228 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	watchtools "k8s.io/client-go/tools/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+const benchmarkNamespace = "default"
+
+// fake client counting list and watch requests
+func countingClient(b testing.TB, requests *atomic.Int64) client.WithWatch {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		b.Fatalf("cannot register scheme: %v", err)
+	}
+	if err := kubecgiv1alpha1.AddToScheme(scheme); err != nil {
+		b.Fatalf("cannot register scheme: %v", err)
+	}
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithIndex(&corev1.Pod{}, metav1.ObjectNameField, func(obj client.Object) []string {
+			return []string{obj.GetName()}
+		}).
+		WithIndex(&corev1.Secret{}, metav1.ObjectNameField, func(obj client.Object) []string {
+			return []string{obj.GetName()}
+		}).
+		WithIndex(&corev1.ConfigMap{}, metav1.ObjectNameField, func(obj client.Object) []string {
+			return []string{obj.GetName()}
+		}).
+		WithIndex(&kubecgiv1alpha1.APISet{}, metav1.ObjectNameField, func(obj client.Object) []string {
+			return []string{obj.GetName()}
+		}).
+		WithIndex(&corev1.Event{}, "involvedObject.uid", func(obj client.Object) []string {
+			return []string{string(obj.(*corev1.Event).InvolvedObject.UID)}
+		}).
+		WithIndex(&corev1.Event{}, "involvedObject.kind", func(obj client.Object) []string {
+			return []string{obj.(*corev1.Event).InvolvedObject.Kind}
+		}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+				requests.Add(1)
+				return c.List(ctx, list, opts...)
+			},
+			Watch: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) (watch.Interface, error) {
+				requests.Add(1)
+				return c.Watch(ctx, list, opts...)
+			},
+		}).
+		Build()
+}
+
+func createBenchmarkPod(b *testing.B, c client.Client, i int) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: benchmarkNamespace,
+			Name:      fmt.Sprintf("pod-%d", i),
+			UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+			Labels:    map[string]string{managedByKey: manager, apisetKey: "apiset"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "cgi"}}},
+	}
+	if err := c.Create(context.Background(), pod); err != nil {
+		b.Fatalf("cannot create pod: %v", err)
+	}
+	return pod
+}
+
+// marks the pod started, as kubelet would
+func startBenchmarkPod(c client.Client, pod *corev1.Pod) {
+	started := true
+	pod = pod.DeepCopy()
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "cgi", Started: &started}}
+	if err := c.Status().Update(context.Background(), pod); err != nil {
+		panic(err)
+	}
+}
+
+// previous approach, watching per request
+func BenchmarkWaitForPodPerRequestWatch(b *testing.B) {
+	var requests atomic.Int64
+	c := countingClient(b, &requests)
+
+	for i := 0; i < b.N; i++ {
+		pod := createBenchmarkPod(b, c, i)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var events corev1.EventList
+		eventOptions := []client.ListOption{
+			client.InNamespace(benchmarkNamespace),
+			client.MatchingFields{"involvedObject.uid": string(pod.UID)},
+		}
+		if err := c.List(ctx, &events, eventOptions...); err != nil {
+			b.Fatalf("cannot list events: %v", err)
+		}
+		eventWatcher, err := c.Watch(ctx, &events, eventOptions...)
+		if err != nil {
+			b.Fatalf("cannot watch events: %v", err)
+		}
+
+		var pods corev1.PodList
+		// fake watches do not replay from resource version
+		podWatcher, err := c.Watch(ctx, &pods,
+			client.InNamespace(benchmarkNamespace),
+			client.MatchingFields{metav1.ObjectNameField: pod.Name})
+		if err != nil {
+			b.Fatalf("cannot watch pod: %v", err)
+		}
+		go startBenchmarkPod(c, pod)
+		_, err = watchtools.UntilWithoutRetry(
+			ctx,
+			podWatcher,
+			func(event watch.Event) (bool, error) {
+				current, ok := event.Object.(*corev1.Pod)
+				return ok && current.Name == pod.Name && containerStarted(current), nil
+			},
+		)
+		if err != nil {
+			b.Fatalf("cannot wait for pod: %v", err)
+		}
+		eventWatcher.Stop()
+		cancel()
+	}
+	b.ReportMetric(float64(requests.Load())/float64(b.N), "requests/op")
+}
+
+func BenchmarkWaitForPodSharedInformers(b *testing.B) {
+	var requests atomic.Int64
+	c := countingClient(b, &requests)
+	informers := NewInformers(c, benchmarkNamespace, "apiset")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx)
+	informers.WaitForCacheSync(ctx)
+	h := kHandler{
+		Namespace: benchmarkNamespace,
+		Spec:      &kubecgiv1alpha1.API{},
+		Informers: informers,
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pod := createBenchmarkPod(b, c, i)
+		go startBenchmarkPod(c, pod)
+		ctx, cancel := context.WithCancel(ctx)
+		go logEventsFor(ctx, informers, pod.UID, nil)
+		_, _, err := h.waitForPod(ctx, pod, nil, nil)
+		if err != nil {
+			b.Fatalf("cannot wait for pod: %v", err)
+		}
+		cancel()
+	}
+	b.ReportMetric(float64(requests.Load())/float64(b.N), "requests/op")
+}
+
+func TestOnAPISetChangeReloads(t *testing.T) {
+	var requests atomic.Int64
+	c := countingClient(t, &requests)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := c.Create(ctx, &kubecgiv1alpha1.APISet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: benchmarkNamespace, Name: "apiset"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create apiset: %v", err)
+	}
+
+	informers := NewInformers(c, benchmarkNamespace, "apiset")
+	var refer atomic.Bool
+	refer.Store(true)
+	loaded := make(chan error)
+	informers.OnAPISetChange(func(*kubecgiv1alpha1.APISet) error {
+		var err error
+		if refer.Load() {
+			_, err = informers.SecretValue(ctx, &kubecgiv1alpha1.SecretKeyRef{Name: "token", Key: "token"})
+		}
+		loaded <- err
+		return err
+	})
+	informers.Start(ctx)
+
+	if err := <-loaded; err == nil {
+		t.Fatalf("expected failure without the secret")
+	}
+	createBenchmarkSecret(t, c)
+	if err := <-loaded; err != nil {
+		t.Fatalf("expected reload on secret creation, got %v", err)
+	}
+
+	refer.Store(false)
+	err = c.Update(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: benchmarkNamespace, Name: "token"},
+		Data:       map[string][]byte{"token": []byte("rotated")},
+	})
+	if err != nil {
+		t.Fatalf("cannot update secret: %v", err)
+	}
+	if err := <-loaded; err != nil {
+		t.Fatalf("expected reload on secret update, got %v", err)
+	}
+
+	// unwatched after f returns
+	referred := func() int {
+		informers.referredMu.Lock()
+		defer informers.referredMu.Unlock()
+		return len(informers.referred)
+	}
+	for deadline := time.Now().Add(time.Second); referred() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected secret no longer watched")
+		}
+	}
+}
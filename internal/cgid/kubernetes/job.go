@@ -0,0 +1,121 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=*
+
+func jobFor(pod *corev1.Pod, spec *kubecgiv1alpha1.JobDispatch) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: *pod.ObjectMeta.DeepCopy(),
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            spec.BackoffLimit,
+			PodFailurePolicy:        spec.PodFailurePolicy.DeepCopy(),
+			TTLSecondsAfterFinished: spec.TTLSecondsAfterFinished,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: maps.Clone(pod.ObjectMeta.Labels),
+				},
+				Spec: *pod.Spec.DeepCopy(),
+			},
+		},
+	}
+}
+
+func jobFinished(job *batchv1.Job) *batchv1.JobCondition {
+	for i, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) &&
+			c.Status == corev1.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func jobFailureStatus(c *batchv1.JobCondition) int {
+	if c.Type == batchv1.JobFailed && c.Reason == batchv1.JobReasonDeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func podReady(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded ||
+		pod.Status.Phase == corev1.PodFailed ||
+		containerStarted(pod)
+}
+
+// waits for a pod of the job not yet tried to start or terminate, or the job
+// to finish without such pod
+func (h kHandler) waitForJobPod(
+	ctx context.Context,
+	job *batchv1.Job,
+	tried map[types.UID]bool,
+	progress *progressHinter,
+) (*corev1.Pod, *batchv1.JobCondition, error) {
+	notified, unsubscribe := h.Informers.notifier.subscribe(
+		jobTopic(job.ObjectMeta.Name), podsOfTopic(job.ObjectMeta.UID))
+	defer unsubscribe()
+
+	observed := false
+	for {
+		pods := h.Informers.podsOf(job.ObjectMeta.UID)
+		sort.Slice(pods, func(i, j int) bool {
+			return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+		})
+		for _, pod := range pods {
+			if tried[pod.ObjectMeta.UID] {
+				continue
+			}
+			progress.observe(pod)
+			if podReady(pod) {
+				return pod, nil, nil
+			}
+		}
+
+		current, ok := h.Informers.job(job.ObjectMeta.Name)
+		if ok {
+			observed = true
+			if condition := jobFinished(current); condition != nil {
+				// pods may be observed later than the job
+				var list corev1.PodList
+				err := h.Client.List(ctx, &list,
+					client.InNamespace(h.Namespace),
+					client.MatchingLabels{batchv1.ControllerUidLabel: string(job.ObjectMeta.UID)})
+				if err != nil {
+					return nil, nil, err
+				}
+				sort.Slice(list.Items, func(i, j int) bool {
+					return list.Items[i].CreationTimestamp.Before(&list.Items[j].CreationTimestamp)
+				})
+				for i := range list.Items {
+					if !tried[list.Items[i].ObjectMeta.UID] && podReady(&list.Items[i]) {
+						return &list.Items[i], nil, nil
+					}
+				}
+				return nil, condition, nil
+			}
+		} else if observed {
+			return nil, nil, fmt.Errorf("job deleted while still waiting")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-notified:
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package kubernetes
+
+import (
+	"net/http"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+func TestJobFor(t *testing.T) {
+	limit := int32(2)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "test-id",
+			Labels: map[string]string{pathKey: "test"},
+		},
+		Spec: corev1.PodSpec{RestartPolicy: corev1.RestartPolicyNever},
+	}
+	job := jobFor(pod, &kubecgiv1alpha1.JobDispatch{BackoffLimit: &limit})
+	if job.Name != pod.Name || *job.Spec.BackoffLimit != limit {
+		t.Errorf("job not built from pod: %v", job)
+	}
+	job.Spec.Template.Labels[gcKey] = "true"
+	if _, ok := pod.Labels[gcKey]; ok {
+		t.Errorf("labels of template shared with pod")
+	}
+}
+
+func TestJobOutcome(t *testing.T) {
+	job := &batchv1.Job{}
+	if _, finished := jobPhase(job); finished {
+		t.Errorf("job without conditions finished")
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{
+		{Type: batchv1.JobSuspended, Status: corev1.ConditionTrue},
+		{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: batchv1.JobReasonDeadlineExceeded},
+	}
+	if phase, _ := jobPhase(job); phase != corev1.PodFailed {
+		t.Errorf("expected phase %v, got %v", corev1.PodFailed, phase)
+	}
+	if status := jobFailureStatus(jobFinished(job)); status != http.StatusGatewayTimeout {
+		t.Errorf("expected status %v, got %v", http.StatusGatewayTimeout, status)
+	}
+
+	job.Status.Conditions[1].Reason = batchv1.JobReasonBackoffLimitExceeded
+	if status := jobFailureStatus(jobFinished(job)); status != http.StatusBadGateway {
+		t.Errorf("expected status %v, got %v", http.StatusBadGateway, status)
+	}
+}
@@ -3,26 +3,31 @@ package kubernetes
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
-	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/remotecommand"
-	watchtools "k8s.io/client-go/tools/watch"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
 	"github.com/xdavidwu/kube-cgi/internal/cgid"
 	"github.com/xdavidwu/kube-cgi/internal/cgid/cgi"
 	"github.com/xdavidwu/kube-cgi/internal/cgid/middlewares"
@@ -30,8 +35,9 @@ import (
 )
 
 // TODO derive config at controller to avoid these
-//+kubebuilder:rbac:groups=kube-cgi.aic.cs.nycu.edu.tw,resources=apisets,verbs=get
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=get
+//+kubebuilder:rbac:groups=kube-cgi.aic.cs.nycu.edu.tw,resources=apisets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
 
 //+kubebuilder:rbac:groups="",resources=pods,verbs=*
 //+kubebuilder:rbac:groups="",resources=pods/log,verbs=get
@@ -48,8 +54,14 @@ func watcherWithOpts(
 	c client.WithWatch,
 	list client.ObjectList,
 	opts ...client.ListOption,
-) cache.Watcher {
+) cache.ListerWatcher {
 	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			merged := append(opts, &client.ListOptions{Raw: &options})
+			result := list.DeepCopyObject().(client.ObjectList)
+			err := c.List(ctx, result, merged...)
+			return result, err
+		},
 		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 			merged := append(opts, &client.ListOptions{Raw: &options})
 			return c.Watch(ctx, list, merged...)
@@ -57,46 +69,31 @@ func watcherWithOpts(
 	}
 }
 
-func logEventsForPod(ctx context.Context, c client.WithWatch, namespace string, uid types.UID) {
-	log := logr.FromContextOrDiscard(ctx)
-	must := func(err error, op string) {
-		if err != nil {
-			log.Error(err, "cannot "+op)
-			panic(err)
-		}
-	}
-
-	log = log.WithValues("source", "events")
-
-	listOptions := []client.ListOption{
-		client.InNamespace(namespace),
-		// k8s.io/kubernetes/pkg/registry/core/event.ToSelectableFields
-		client.MatchingFields{"involvedObject.uid": string(uid)},
-	}
-
-	var list corev1.EventList
-	must(c.List(ctx, &list, listOptions...), "list events")
-	for _, event := range list.Items {
-		log.Info(event.Message)
-	}
+func logEventsFor(ctx context.Context, informers *Informers, uid types.UID, events *eventRecorder) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("source", "events")
 
-	watcher, err := watchtools.NewRetryWatcher(
-		list.ListMeta.ResourceVersion,
-		watcherWithOpts(ctx, c, &list, listOptions...),
-	)
-	must(err, "watch events")
+	notified, unsubscribe := informers.notifier.subscribe(eventsTopic(uid))
+	defer unsubscribe()
 
-	results := watcher.ResultChan()
+	logged := map[types.UID]bool{}
 	for {
+		list := informers.eventsFor(uid)
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].CreationTimestamp.Before(&list[j].CreationTimestamp)
+		})
+		for _, event := range list {
+			if logged[event.ObjectMeta.UID] {
+				continue
+			}
+			logged[event.ObjectMeta.UID] = true
+			log.Info(event.Message)
+			events.record(event)
+		}
+
 		select {
 		case <-ctx.Done():
-			watcher.Stop()
 			return
-		case watchEvent := <-results:
-			if watchEvent.Type == watch.Added {
-				event := watchEvent.Object.(*corev1.Event)
-				log.Info(event.Message)
-			}
+		case <-notified:
 		}
 	}
 }
@@ -118,24 +115,232 @@ func escapeKubernetesExpansion(i string) string {
 }
 
 func containerStarted(pod *corev1.Pod) bool {
-	if len(pod.Status.ContainerStatuses) > 0 {
-		c := pod.Status.ContainerStatuses[0]
-		return c.Started != nil && *c.Started
+	// there may be sidecars
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.Name == pod.Spec.Containers[0].Name {
+			return c.Started != nil && *c.Started
+		}
 	}
 	return false
 }
 
 type kHandler KubernetesHandler
 
-func (h kHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+func (h kHandler) attach(name, container string, stdout bool) (remotecommand.Executor, error) {
+	url := h.OldClient.CoreV1().RESTClient().Post().
+		Namespace(h.Namespace).Resource("pods").
+		Name(name).SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: container,
+			Stdin:     true,
+			Stdout:    stdout,
+			Stderr:    false,
+			TTY:       false,
+		}, scheme.ParameterCodec).URL()
+	return remotecommand.NewSPDYExecutor(h.ClientConfig, "POST", url)
+}
+
+func (h kHandler) release(log logr.Logger, obj client.Object) {
+	release(context.Background(), log, h.Client, obj)
+	h.Inflight.remove(obj)
+}
+
+var errSchedulingTimeout = errors.New("pod not scheduled in time")
+
+// waits for the pod to start or terminate, or fail to dispatch
+func (h kHandler) waitForPod(
+	ctx context.Context,
+	pod *corev1.Pod,
+	events *eventRecorder,
+	progress *progressHinter,
+) (*corev1.Pod, string, error) {
+	notified, unsubscribe := h.Informers.notifier.subscribe(podTopic(pod.ObjectMeta.Name))
+	defer unsubscribe()
+
+	var timeout <-chan time.Time
+	if h.Spec.Dispatch != nil && h.Spec.Dispatch.SchedulingTimeoutSeconds != nil {
+		timer := time.NewTimer(time.Duration(*h.Spec.Dispatch.SchedulingTimeoutSeconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	observed := false
+	for {
+		current, ok := h.Informers.pod(pod.ObjectMeta.Name)
+		if ok {
+			observed = true
+			progress.observe(current)
+			if podScheduled(current) {
+				timeout = nil
+			}
+			failure := ""
+			if !containerStarted(current) {
+				failure = dispatchFailure(current, events)
+			}
+			if failure != "" || podReady(current) {
+				return current, failure, nil
+			}
+		} else if observed {
+			return pod, "Deleted", nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-timeout:
+			return nil, "", errSchedulingTimeout
+		case <-notified:
+		}
+	}
+}
+
+var errNotAttached = errors.New("container terminated before attaching")
+
+// streams CGI response from the pod
+func (h kHandler) respond(ctx context.Context, w http.ResponseWriter, pod *corev1.Pod, stdin io.Reader) error {
 	log := logr.FromContextOrDiscard(ctx)
-	must := func(err error, op string) {
+	container := &pod.Spec.Containers[0]
+
+	if !container.Stdin || !containerStarted(pod) {
+		stdin = nil
+	}
+
+	var reader io.ReadCloser
+	if h.Spec.Response != nil && h.Spec.Response.Source == kubecgiv1alpha1.ResponseSourceAttach {
+		if !containerStarted(pod) {
+			return errNotAttached
+		}
+		attach, err := h.attach(pod.ObjectMeta.Name, container.Name, true)
+		// does not really fire request yet, nothing should happen
+		if err != nil {
+			return fmt.Errorf("cannot attach pod: %w", err)
+		}
+
+		var stdout *io.PipeWriter
+		reader, stdout = io.Pipe()
+		go func() {
+			log.Info("streaming with attach")
+			err := attach.StreamWithContext(ctx, remotecommand.StreamOptions{
+				Stdin:  stdin,
+				Stdout: stdout,
+				Stderr: nil,
+				Tty:    false,
+			})
+			if err != nil {
+				log.Error(err, "streaming with attach")
+			}
+			stdout.CloseWithError(err)
+		}()
+	} else {
+		if stdin != nil {
+			attach, err := h.attach(pod.ObjectMeta.Name, container.Name, false)
+			// does not really fire request yet, nothing should happen
+			if err != nil {
+				return fmt.Errorf("cannot attach pod: %w", err)
+			}
+
+			go func() {
+				log.Info("streaming input to pod")
+				err := attach.StreamWithContext(ctx, remotecommand.StreamOptions{
+					Stdin:  stdin,
+					Stdout: nil,
+					Stderr: nil,
+					Tty:    false,
+				})
+				if err != nil {
+					log.Error(err, "streaming input")
+				} else {
+					log.Info("request body fully streamed")
+				}
+			}()
+		}
+
+		// XXX dynamic client supports only CRUD subresources
+		pods := h.OldClient.CoreV1().Pods(h.Namespace)
+		var err error
+		reader, err = pods.GetLogs(pod.ObjectMeta.Name, &corev1.PodLogOptions{
+			Container: container.Name,
+			Follow:    true,
+		}).Stream(ctx)
 		if err != nil {
-			log.Error(err, "cannot "+op)
-			panic(err)
+			return fmt.Errorf("cannot get pod logs: %w", err)
 		}
 	}
+	log.Info("ready for streaming response")
+	defer reader.Close()
+
+	redir, err := cgi.WriteResponse(w, reader)
+	if redir != "" {
+		log.Info("internal redirects not implemented")
+		return &cgid.Error{
+			Status:  http.StatusNotImplemented,
+			Class:   cgid.ClassScript,
+			Message: "internal redirects not implemented",
+		}
+	}
+	return err
+}
+
+// creates the secret of form files owned by the dispatched unit, per attempt
+// as pods of failed ones may be deleted
+func (h kHandler) createFormSecret(unit client.Object, data map[string][]byte) error {
+	ref, err := OwnerReferenceOf(h.Client, unit)
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       h.Namespace,
+			Name:            unit.GetName() + "-form",
+			Labels:          map[string]string{managedByKey: manager},
+			OwnerReferences: []metav1.OwnerReference{ref},
+		},
+		Data: data,
+	}
+	return h.Client.Create(context.Background(), secret)
+}
+
+// tracks whether the response has started, after which errors cannot be
+// responded
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) WriteHeader(statusCode int) {
+	// not on informational ones, e.g. progress hints
+	if statusCode >= 200 {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *startedWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *startedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (h kHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := h.serve(w, r)
+	if err != nil {
+		cgid.WriteErrorFrom(w, r, err)
+	}
+}
+
+// returns errors to respond with, if nothing is responded yet
+func (h kHandler) serve(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := logr.FromContextOrDiscard(ctx)
+	response := &startedWriter{ResponseWriter: w}
+	w = response
+	failed := func(err error, op string) error {
+		log.Error(err, "cannot "+op)
+		return cgid.FromKubernetes(fmt.Errorf("cannot %s: %w", op, err))
+	}
 
 	path := namify(h.Spec.Path)
 	input := cgid.BodyFromContext(ctx)
@@ -147,17 +352,38 @@ func (h kHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				managedByKey:  manager,
 				generationKey: strconv.FormatInt(h.Generation, 10),
 				pathKey:       path,
+				apisetKey:     h.OwnerReference.Name,
 			},
 			OwnerReferences: []metav1.OwnerReference{h.OwnerReference},
 		},
 	}
 	h.Spec.PodSpec.DeepCopyInto(&pod.Spec)
+	// of the dispatched unit, pod or job
+	name := pod.ObjectMeta.Name
+
+	var artifactsSpec *kubecgiv1alpha1.Artifacts
+	if h.Spec.Response != nil && h.Spec.Response.Artifacts != nil {
+		if h.Artifacts != nil {
+			artifactsSpec = h.Spec.Response.Artifacts
+			addArtifactsSidecar(pod, artifactsSpec)
+		} else {
+			log.Info("artifact storage not configured, not collecting artifacts")
+		}
+	}
 	container := &pod.Spec.Containers[0]
 
+	artifactsURL := ""
+	if artifactsSpec != nil {
+		artifactsURL = h.Artifacts.URL(name)
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  cgid.ArtifactsEnvKey,
+			Value: escapeKubernetesExpansion(artifactsURL),
+		})
+	}
+
 	for k, v := range cgi.VarsFromRequest(r) {
 		if cgid.EnvTooLarge(k, v) {
-			cgid.WriteError(w, http.StatusRequestHeaderFieldsTooLarge, "")
-			return
+			return &cgid.Error{Status: http.StatusRequestHeaderFieldsTooLarge, Class: cgid.ClassRequest}
 		}
 		container.Env = append(container.Env, corev1.EnvVar{
 			Name:  k,
@@ -165,7 +391,48 @@ func (h kHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	if input != nil {
+	var f *form
+	if h.Spec.Request != nil && h.Spec.Request.Form != nil {
+		mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "multipart/form-data" {
+			var body io.Reader = r.Body
+			if input != nil {
+				body = bytes.NewReader(input)
+			}
+			var err error
+			f, err = readForm(multipart.NewReader(body, params["boundary"]), name, h.Spec.Request.Form)
+			defer func() {
+				err := f.cleanup(h.Spec.Request.Form)
+				if err != nil {
+					log.Error(err, "cannot clean up form files")
+				}
+			}()
+			if errors.Is(err, errFormTooLarge) {
+				log.Info("form too large")
+				return &cgid.Error{Status: http.StatusRequestEntityTooLarge, Class: cgid.ClassRequest}
+			} else if err != nil {
+				log.Info("cannot read form", "error", err.Error())
+				return &cgid.Error{Status: http.StatusBadRequest, Class: cgid.ClassRequest, Message: "malformed form"}
+			}
+
+			for _, env := range f.env {
+				if cgid.EnvTooLarge(env.Name, env.Value) {
+					return &cgid.Error{Status: http.StatusRequestEntityTooLarge, Class: cgid.ClassRequest}
+				}
+				env.Value = escapeKubernetesExpansion(env.Value)
+				container.Env = append(container.Env, env)
+			}
+			container.VolumeMounts = append(container.VolumeMounts, f.mounts...)
+			pod.Spec.Volumes = append(pod.Spec.Volumes,
+				f.volumes(name+"-form", h.Spec.Request.Form)...)
+			// consumed, stdin gets EOF
+			input = nil
+		}
+	}
+
+	if f != nil {
+		log.Info("request body passed as form")
+	} else if input != nil {
 		container.Env = append(container.Env, corev1.EnvVar{
 			Name:  cgid.BodyEnvKey,
 			Value: escapeKubernetesExpansion(string(input)),
@@ -173,167 +440,277 @@ func (h kHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		if !container.Stdin {
 			log.Info("request body not drained for env but script does not accept stdin, rejecting request")
-			cgid.WriteError(w, http.StatusRequestEntityTooLarge, "")
-			return
+			return &cgid.Error{Status: http.StatusRequestEntityTooLarge, Class: cgid.ClassRequest}
+		}
+		if h.Spec.Dispatch != nil && h.Spec.Dispatch.Job != nil {
+			// replacement pods cannot read it again
+			log.Info("request body not drained for env but job may replace pods, rejecting request")
+			return &cgid.Error{Status: http.StatusRequestEntityTooLarge, Class: cgid.ClassRequest}
 		}
 		log.Info("request body not drained for env, relying on stdin only for request body")
 	}
 
-	err := h.Client.Create(context.Background(), pod)
-	must(err, "create pod")
+	var job *batchv1.Job
+	var unit client.Object = pod
+	kind := "pod"
+	if h.Spec.Dispatch != nil && h.Spec.Dispatch.Job != nil {
+		job = jobFor(pod, h.Spec.Dispatch.Job)
+		unit = job
+		kind = "job"
+	}
+
+	// for retries
+	template := pod.DeepCopy()
+	err := h.Client.Create(context.Background(), unit)
+	if err != nil {
+		return failed(err, "create "+kind)
+	}
+	dispatchedAt := time.Now()
+	// released only after the request, unless observed deleted
+	dispatched := []client.Object{unit}
+	h.Inflight.add(unit)
 	defer func() {
-		go func() {
-			patch := corev1ac.Pod(pod.Name, pod.Namespace).
-				WithLabels(map[string]string{gcKey: "true"})
-			u := unstructured.Unstructured{}
-			u.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(patch)
-			if err != nil {
-				log.Error(err, "cannot prepare patch")
-				return
+		for _, obj := range dispatched {
+			go h.release(log, obj)
+		}
+	}()
+
+	// of the pod being followed
+	var served *corev1.Pod
+	if artifactsSpec != nil {
+		// also lets sidecars terminate, thus always needed
+		defer func() {
+			collected := ""
+			if served != nil {
+				collected = served.ObjectMeta.Name
+				// still useful after client goes away
+				err := h.collectArtifacts(context.WithoutCancel(ctx), collected, name, artifactsSpec)
+				if err != nil {
+					log.Error(err, "cannot collect artifacts")
+				} else {
+					log.Info("artifacts collected")
+				}
 			}
-			err = h.Client.Patch(context.Background(), &u, client.Apply, client.ForceOwnership, client.FieldOwner(manager))
-			if err != nil {
-				log.Error(err, "cannot apply patch")
-				return
+			for _, obj := range dispatched {
+				go h.terminateSidecars(log, obj, collected)
 			}
 		}()
-	}()
+	}
+
+	if f != nil && len(f.secret) != 0 {
+		err = h.createFormSecret(unit, f.secret)
+		if err != nil {
+			return failed(err, "create secret")
+		}
+	}
 
-	log.Info("dispatched pod", "name", pod.ObjectMeta.Name)
-	go logEventsForPod(ctx, h.Client, h.Namespace, pod.ObjectMeta.UID)
+	log.Info("dispatched "+kind, "name", name)
+	if job == nil {
+		w.Header().Set(cgid.PodHeader, pod.ObjectMeta.Name)
+	}
+	progress := newProgressHinter(w, r, h.Spec.Response != nil && h.Spec.Response.ProgressHints)
+	events := &eventRecorder{}
+	go logEventsFor(ctx, h.Informers, unit.GetUID(), events)
 
-	var list corev1.PodList
-	watchOptions := []client.ListOption{
-		client.InNamespace(h.Namespace),
-		// k8s.io/kubernetes/pkg/registry/core/pod.ToSelectableFields
-		client.MatchingFields{metav1.ObjectNameField: string(pod.ObjectMeta.Name)},
+	retryLimit := int32(0)
+	if h.Spec.Dispatch != nil && h.Spec.Dispatch.RetryLimit != nil {
+		retryLimit = *h.Spec.Dispatch.RetryLimit
 	}
-	lastEvent, err := watchtools.Until(
-		ctx,
-		pod.ObjectMeta.ResourceVersion,
-		watcherWithOpts(ctx, h.Client, &list, watchOptions...),
-		func(event watch.Event) (bool, error) {
-			if event.Type == watch.Deleted {
-				return false, fmt.Errorf("pod deleted while still waiting")
+	attempt := int32(0)
+	tried := map[types.UID]bool{}
+	// read from r.Body, which cannot be streamed again for retries
+	streamed := f == nil && input == nil
+	attached := false
+	for {
+		failure := ""
+		if job == nil {
+			served, failure, err = h.waitForPod(ctx, pod, events, progress)
+			if errors.Is(err, errSchedulingTimeout) {
+				current := &corev1.Pod{}
+				err := h.Client.Get(context.Background(), client.ObjectKeyFromObject(pod), current)
+				if err != nil {
+					current = pod
+				}
+				reason := schedulingFailure(current, events)
+				log.Info("pod not scheduled in time, deleting", "name", pod.ObjectMeta.Name, "reason", reason)
+				err = client.IgnoreNotFound(h.Client.Delete(context.Background(), pod))
+				if err != nil {
+					return failed(err, "delete pod")
+				}
+				// avoid recreating by release
+				dispatched = dispatched[:len(dispatched)-1]
+				h.Inflight.remove(pod)
+				failure = "scheduling timed out: " + reason
+			} else if err != nil {
+				return failed(err, "watch pod")
 			}
-			if event.Type != watch.Added && event.Type != watch.Modified {
-				return false, nil
+		} else {
+			var finished *batchv1.JobCondition
+			served, finished, err = h.waitForJobPod(ctx, job, tried, progress)
+			if err != nil {
+				return failed(err, "watch job")
 			}
-			pod := event.Object.(*corev1.Pod)
-			if pod.Status.Phase == corev1.PodSucceeded ||
-				pod.Status.Phase == corev1.PodFailed {
-				return true, nil
+			if finished != nil {
+				if finished.Type == batchv1.JobFailed {
+					log.Info("job failed", "reason", finished.Reason, "message", finished.Message)
+					return &cgid.Error{
+						Status:  jobFailureStatus(finished),
+						Class:   cgid.ClassDispatch,
+						Message: "job failed: " + finished.Reason,
+					}
+				}
+				log.Info("job completed without cgi response")
+				return &cgid.Error{Status: http.StatusBadGateway, Class: cgid.ClassScript}
 			}
-			return containerStarted(pod), nil
-		},
-	)
-	must(err, "watch pod")
-	pod = lastEvent.Object.(*corev1.Pod)
-
-	if container.Stdin && containerStarted(pod) {
-		url := h.OldClient.CoreV1().RESTClient().Post().
-			Namespace(h.Namespace).Resource("pods").
-			Name(pod.ObjectMeta.Name).SubResource("attach").
-			VersionedParams(&corev1.PodAttachOptions{
-				Container: container.Name,
-				Stdin:     true,
-				Stdout:    false,
-				Stderr:    false,
-				TTY:       false,
-			}, scheme.ParameterCodec).URL()
-		attach, err := remotecommand.NewSPDYExecutor(h.ClientConfig, "POST", url)
-		// does not really fire request yet, nothing should happen
-		must(err, "attach pod")
+			tried[served.ObjectMeta.UID] = true
+			w.Header().Set(cgid.PodHeader, served.ObjectMeta.Name)
+			log.Info("following pod", "name", served.ObjectMeta.Name)
+			go logEventsFor(ctx, h.Informers, served.ObjectMeta.UID, nil)
+		}
 
-		var reader io.Reader
-		if input != nil {
-			reader = bytes.NewReader(input)
-		} else {
-			reader = r.Body
+		if failure == "" {
+			if containerStarted(served) {
+				podStartDuration.WithLabelValues(h.Spec.Path).Observe(time.Since(dispatchedAt).Seconds())
+			}
+
+			var stdin io.Reader = r.Body
+			if input != nil {
+				stdin = bytes.NewReader(input)
+			}
+			if streamed && container.Stdin && containerStarted(served) {
+				attached = true
+			}
+			if artifactsSpec != nil {
+				w.Header().Set(cgid.ArtifactsHeader, artifactsURL)
+			}
+			err = h.respond(ctx, w, served, stdin)
+
+			if job == nil && (errors.Is(err, cgi.ErrNoHeaders) || errors.Is(err, errNotAttached)) {
+				// status may be observed later than end of logs
+				current := &corev1.Pod{}
+				getErr := h.Client.Get(context.WithoutCancel(ctx), client.ObjectKeyFromObject(served), current)
+				if apierrors.IsNotFound(getErr) {
+					failure = "Deleted"
+				} else if getErr == nil {
+					failure = dispatchFailure(current, events)
+				}
+			}
 		}
 
-		go func() {
-			log.Info("streaming input to pod")
-			err := attach.StreamWithContext(ctx, remotecommand.StreamOptions{
-				Stdin:  reader,
-				Stdout: nil,
-				Stderr: nil,
-				Tty:    false,
-			})
+		if failure != "" {
+			log.Info("pod failed to dispatch", "name", pod.ObjectMeta.Name, "reason", failure)
+			if failure == "Deleted" {
+				// avoid recreating by release
+				dispatched = dispatched[:len(dispatched)-1]
+				h.Inflight.remove(pod)
+			}
+			if attached && attempt < retryLimit {
+				log.Info("request body already streamed, not retrying")
+			}
+			if attempt >= retryLimit || attached {
+				return &cgid.Error{
+					Status:  http.StatusServiceUnavailable,
+					Class:   cgid.ClassDispatch,
+					Message: "dispatch failed: " + failure,
+				}
+			}
+			attempt += 1
+			pod = template.DeepCopy()
+			pod.ObjectMeta.Name = fmt.Sprintf("%s-%d", name, attempt)
+			if f != nil && len(f.secret) != 0 {
+				for i := range pod.Spec.Volumes {
+					if pod.Spec.Volumes[i].Name == formSecretVolumeName {
+						pod.Spec.Volumes[i].Secret.SecretName = pod.ObjectMeta.Name + "-form"
+					}
+				}
+			}
+			err = h.Client.Create(context.Background(), pod)
 			if err != nil {
-				log.Error(err, "streaming input")
-			} else {
-				log.Info("request body fully streamed")
+				return failed(err, "create pod")
 			}
-		}()
-	}
-	log.Info("ready for streaming response")
+			dispatchedAt = time.Now()
+			dispatched = append(dispatched, pod)
+			h.Inflight.add(pod)
+			if f != nil && len(f.secret) != 0 {
+				err = h.createFormSecret(pod, f.secret)
+				if err != nil {
+					return failed(err, "create secret")
+				}
+			}
+			w.Header().Set(cgid.PodHeader, pod.ObjectMeta.Name)
+			log.Info("dispatched pod for retry", "name", pod.ObjectMeta.Name, "attempt", attempt)
+			events = &eventRecorder{}
+			go logEventsFor(ctx, h.Informers, pod.ObjectMeta.UID, events)
+			continue
+		}
 
-	// XXX dynamic client supports only CRUD subresources
-	pods := h.OldClient.CoreV1().Pods(h.Namespace)
-	reader, err := pods.GetLogs(pod.ObjectMeta.Name, &corev1.PodLogOptions{
-		Container: container.Name,
-		Follow:    true,
-	}).Stream(ctx)
-	must(err, "get pod logs")
-	defer reader.Close()
-	redir, err := cgi.WriteResponse(w, reader)
-	if redir != "" {
-		log.Info("internal redirects not implemented")
-		panic("not implemented")
+		if job != nil && (errors.Is(err, cgi.ErrNoHeaders) || errors.Is(err, errNotAttached)) {
+			log.Info("pod terminated without cgi response, waiting for replacement", "error", err.Error())
+			if artifactsSpec != nil {
+				err := h.terminateSidecar(context.WithoutCancel(ctx), served.ObjectMeta.Name)
+				if err != nil {
+					log.Error(err, "cannot terminate sidecar")
+				}
+			}
+			continue
+		}
+		break
 	}
-	if err != nil {
-		cgid.WriteError(w, http.StatusInternalServerError, "")
+
+	if errors.Is(err, errNotAttached) {
+		log.Info("container terminated before attaching, response lost")
+		return &cgid.Error{Status: http.StatusBadGateway, Class: cgid.ClassScript, Err: err}
+	} else if errors.Is(err, cgi.ErrLengthMismatch) {
+		// headers already sent
+		responseLengthMismatches.WithLabelValues(h.Spec.Path).Inc()
+		log.Error(err, "cgi response corrupted")
+	} else if err != nil {
 		log.Error(err, "cannot proxy cgi response")
+		if response.started {
+			// headers already sent
+			return nil
+		}
+		return err
 	} else {
 		log.Info("response streamed")
 	}
+	return nil
 }
 
-// TODO do init stuff elsewhere
-func (h KubernetesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var stack http.Handler = kHandler(h)
+// wraps next with request processing of the API
+func (h KubernetesHandler) middlewares(ctx context.Context, next http.Handler) (http.Handler, error) {
+	stack := next
 
 	if h.Spec.Request != nil {
 		rSpec := h.Spec.Request
-		log := logr.FromContextOrDiscard(r.Context())
 
 		if rSpec.Schema != nil {
-			schema, err := schema.CompileString(rSpec.Schema.RawJSON)
+			schema, err := schema.CompileString(rSpec.Schema.RawJSON, h.Informers.ConfigMaps(ctx))
 			if err != nil {
-				log.Error(err, "cannot compile schema", "schema", rSpec.Schema.RawJSON)
-				panic(err)
+				return nil, fmt.Errorf("cannot compile schema of %s: %w", h.Spec.Path, err)
 			}
-			stack = middlewares.ValidateJson(stack, schema)
+			stack = middlewares.ValidateJson(stack, schema, rSpec.ValidationOutput)
 		}
 
 		if rSpec.Authentication != nil &&
 			rSpec.Authentication.PreShared != nil &&
 			rSpec.Authentication.PreShared.SecretKeyRef != nil {
-			ref := rSpec.Authentication.PreShared.SecretKeyRef
-
-			var secret corev1.Secret
-			err := h.Client.Get(
-				r.Context(),
-				client.ObjectKey{Namespace: h.Namespace, Name: ref.Name},
-				&secret,
-			)
+			secret, err := h.Informers.SecretValue(ctx, rSpec.Authentication.PreShared.SecretKeyRef)
 			if err != nil {
-				log.Error(err, "cannot get secret", "namespace", h.Namespace, "name", ref.Name)
-				panic(err)
+				return nil, fmt.Errorf("cannot get pre-shared token of %s: %w", h.Spec.Path, err)
 			}
-
-			v, ok := secret.Data[ref.Key]
-			if !ok {
-				err = fmt.Errorf("referred key not found in secret")
-				log.Error(err, "cannot get pre-shared token", "namespace", h.Namespace, "name", ref.Name, "key", ref.Key)
-				panic(err)
-			}
-			stack = middlewares.AuthnWithPreShared(stack, string(v))
+			stack = middlewares.AuthnWithPreShared(stack, secret)
 		}
 	}
 
-	middlewares.Instrument(middlewares.LogWithIdentifier(
-		middlewares.DrainBody(stack)), h.Spec.Path).
-		ServeHTTP(w, r)
+	stack = middlewares.DrainBody(stack)
+	if h.CORS != nil {
+		stack = middlewares.CORS(stack, h.CORS, h.Spec.ServedMethods())
+	}
+	return middlewares.Instrument(middlewares.LogWithIdentifier(stack), h.Spec.Path), nil
+}
+
+// Build prepares the handler of the API, failing on invalid configurations
+func (h KubernetesHandler) Build(ctx context.Context) (http.Handler, error) {
+	return h.middlewares(ctx, kHandler(h))
 }
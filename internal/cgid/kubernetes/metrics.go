@@ -0,0 +1,27 @@
+package kubernetes
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	responseLengthMismatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cgi_response_length_mismatches_total",
+			Help: "Number of CGI responses with body length not matching declared Content-Length",
+		},
+		[]string{"handler"},
+	)
+	podStartDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cgi_pod_start_duration_seconds",
+			Help:    "Time from dispatch to the script container being started",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+		[]string{"handler"},
+	)
+)
+
+func MustRegisterCollectors(r *prometheus.Registry) {
+	r.MustRegister(responseLengthMismatches, podStartDuration)
+}
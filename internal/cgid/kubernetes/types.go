@@ -7,12 +7,14 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/artifacts"
 )
 
 var (
 	generationKey = kubecgiv1alpha1.GroupVersion.Group + "/generation"
 	pathKey       = kubecgiv1alpha1.GroupVersion.Group + "/path"
 	gcKey         = kubecgiv1alpha1.GroupVersion.Group + "/released"
+	apisetKey     = kubecgiv1alpha1.GroupVersion.Group + "/apiset"
 )
 
 type KubernetesHandler struct {
@@ -21,6 +23,10 @@ type KubernetesHandler struct {
 	ClientConfig   *rest.Config
 	Namespace      string
 	Spec           *kubecgiv1alpha1.API
+	CORS           *kubecgiv1alpha1.CORS
 	OwnerReference metav1.OwnerReference
 	Generation     int64
+	Artifacts      *artifacts.Artifacts
+	Informers      *Informers
+	Inflight       *Inflight
 }
@@ -0,0 +1,19 @@
+package cgid
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cgi_errors_total",
+			Help: "Number of error responses, by class of the error",
+		},
+		[]string{"class"},
+	)
+)
+
+func MustRegisterCollectors(r *prometheus.Registry) {
+	r.MustRegister(errorsTotal)
+}
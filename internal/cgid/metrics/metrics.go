@@ -9,6 +9,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/kubernetes"
 	"github.com/xdavidwu/kube-cgi/internal/cgid/middlewares"
 )
 
@@ -29,7 +31,9 @@ func MetricHandler(l logr.Logger) http.Handler {
 		),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
+	cgid.MustRegisterCollectors(prometheus)
 	middlewares.MustRegisterCollectors(prometheus)
+	kubernetes.MustRegisterCollectors(prometheus)
 
 	return promhttp.InstrumentMetricHandler(
 		prometheus,
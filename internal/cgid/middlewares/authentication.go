@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/go-logr/logr"
+
 	"github.com/xdavidwu/kube-cgi/internal/cgid"
 )
 
@@ -19,16 +21,24 @@ func bearerTokenFromRequest(r *http.Request) string {
 	return v[len(bearerType):]
 }
 
-func AuthnWithPreShared(next http.Handler, secret string) http.Handler {
+// secret is looked up on each request, to follow rotation
+func AuthnWithPreShared(next http.Handler, secret func() ([]byte, error)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t := bearerTokenFromRequest(r)
 
 		if t == "" {
-			cgid.WriteError(w, http.StatusUnauthorized, "")
+			cgid.WriteError(w, r, http.StatusUnauthorized, "")
+			return
+		}
+		v, err := secret()
+		if err != nil {
+			log := logr.FromContextOrDiscard(r.Context())
+			log.Error(err, "cannot get pre-shared token")
+			cgid.WriteError(w, r, http.StatusInternalServerError, "")
 			return
 		}
-		if t != secret {
-			cgid.WriteError(w, http.StatusForbidden, "")
+		if t != string(v) {
+			cgid.WriteError(w, r, http.StatusForbidden, "")
 			return
 		}
 
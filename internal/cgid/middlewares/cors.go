@@ -0,0 +1,116 @@
+package middlewares
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+const (
+	allowOriginHeader      = "Access-Control-Allow-Origin"
+	allowCredentialsHeader = "Access-Control-Allow-Credentials"
+	allowMethodsHeader     = "Access-Control-Allow-Methods"
+	allowHeadersHeader     = "Access-Control-Allow-Headers"
+	exposeHeadersHeader    = "Access-Control-Expose-Headers"
+	maxAgeHeader           = "Access-Control-Max-Age"
+	requestMethodHeader    = "Access-Control-Request-Method"
+	requestHeadersHeader   = "Access-Control-Request-Headers"
+)
+
+// IsPreflight reports whether r is a CORS preflight request
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" && r.Header.Get(requestMethodHeader) != ""
+}
+
+// sets headers not set by scripts, as the response is written
+type corsWriter struct {
+	http.ResponseWriter
+	headers http.Header
+	applied bool
+}
+
+func (w *corsWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.ResponseWriter.Header()
+	for k, vs := range w.headers {
+		if k == "Vary" {
+			h[k] = append(h[k], vs...)
+		} else if _, ok := h[k]; !ok {
+			h[k] = vs
+		}
+	}
+}
+
+func (w *corsWriter) WriteHeader(statusCode int) {
+	// not on informational ones, e.g. 103 Early Hints
+	if statusCode >= 200 {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// CORS answers preflight requests without calling next, and adds headers
+// to actual requests from allowed origins
+func CORS(next http.Handler, policy *kubecgiv1alpha1.CORS, methods []string) http.Handler {
+	anyOrigin := slices.Contains(policy.AllowOrigins, "*")
+	allowMethods := policy.AllowMethods
+	if len(allowMethods) == 0 {
+		allowMethods = methods
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		headers := http.Header{"Vary": {"Origin"}}
+		allowed := origin != "" && (anyOrigin || slices.Contains(policy.AllowOrigins, origin))
+		if allowed {
+			if anyOrigin && !policy.AllowCredentials {
+				headers.Set(allowOriginHeader, "*")
+			} else {
+				headers.Set(allowOriginHeader, origin)
+			}
+			if policy.AllowCredentials {
+				headers.Set(allowCredentialsHeader, "true")
+			}
+		}
+
+		if IsPreflight(r) {
+			headers.Add("Vary", requestMethodHeader)
+			headers.Add("Vary", requestHeadersHeader)
+			if allowed {
+				headers.Set(allowMethodsHeader, strings.Join(allowMethods, ", "))
+				if len(policy.AllowHeaders) != 0 {
+					headers.Set(allowHeadersHeader, strings.Join(policy.AllowHeaders, ", "))
+				}
+				if policy.MaxAgeSeconds != nil {
+					headers.Set(maxAgeHeader, strconv.Itoa(int(*policy.MaxAgeSeconds)))
+				}
+			}
+			for k, vs := range headers {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed && len(policy.ExposeHeaders) != 0 {
+			headers.Set(exposeHeadersHeader, strings.Join(policy.ExposeHeaders, ", "))
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, headers: headers}, r)
+	})
+}
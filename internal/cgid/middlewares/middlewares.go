@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/santhosh-tekuri/jsonschema/v6"
 	"k8s.io/apimachinery/pkg/util/rand"
 
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
 	"github.com/xdavidwu/kube-cgi/internal/cgid"
 )
 
@@ -25,8 +27,10 @@ func DrainBody(next http.Handler) http.Handler {
 		} else {
 			bytes, err = io.ReadAll(http.MaxBytesReader(w, r.Body, r.ContentLength))
 			if err != nil {
-				log.Error(err, "cannot drain body")
-				panic(err)
+				// shorter than declared, or connection gone
+				log.Info("cannot drain body", "error", err.Error())
+				cgid.WriteError(w, r, http.StatusBadRequest, "cannot read request body")
+				return
 			}
 		}
 
@@ -35,7 +39,7 @@ func DrainBody(next http.Handler) http.Handler {
 	})
 }
 
-func ValidateJson(next http.Handler, jsonSchema *jsonschema.Schema) http.Handler {
+func ValidateJson(next http.Handler, jsonSchema *jsonschema.Schema, output kubecgiv1alpha1.ValidationOutput) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		bytes := cgid.BodyFromContext(r.Context())
 		if bytes == nil {
@@ -47,11 +51,20 @@ func ValidateJson(next http.Handler, jsonSchema *jsonschema.Schema) http.Handler
 
 		var v any
 		if json.Unmarshal(bytes, &v) != nil {
-			cgid.WriteError(w, http.StatusUnprocessableEntity, "request body is not json")
+			cgid.WriteError(w, r, http.StatusUnprocessableEntity, "request body is not json")
 			return
 		}
 		if err := jsonSchema.Validate(v); err != nil {
-			cgid.WriteError(w, http.StatusUnprocessableEntity, err.Error())
+			e := &cgid.Error{
+				Status:  http.StatusUnprocessableEntity,
+				Class:   cgid.ClassRequest,
+				Message: "request body does not match schema",
+			}
+			var verr *jsonschema.ValidationError
+			if errors.As(err, &verr) && output != kubecgiv1alpha1.ValidationOutputFlag {
+				e.Details = validationDetails(verr, output)
+			}
+			cgid.WriteErrorFrom(w, r, e)
 			return
 		}
 
@@ -59,6 +72,37 @@ func ValidateJson(next http.Handler, jsonSchema *jsonschema.Schema) http.Handler
 	})
 }
 
+func detailFrom(unit *jsonschema.OutputUnit) cgid.Detail {
+	d := cgid.Detail{
+		InstanceLocation: unit.InstanceLocation,
+		KeywordLocation:  unit.KeywordLocation,
+	}
+	if unit.Error != nil {
+		d.Message = unit.Error.String()
+	}
+	for i := range unit.Errors {
+		d.Errors = append(d.Errors, detailFrom(&unit.Errors[i]))
+	}
+	return d
+}
+
+// errors under the root output unit, without absolute keyword locations
+// revealing the schema URL
+func validationDetails(err *jsonschema.ValidationError, output kubecgiv1alpha1.ValidationOutput) []cgid.Detail {
+	root := err.BasicOutput()
+	if output == kubecgiv1alpha1.ValidationOutputDetailed {
+		root = err.DetailedOutput()
+	}
+	return detailFrom(root).Errors
+}
+
+// WithProblemDetails makes errors responded in RFC 9457 Problem Details
+func WithProblemDetails(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(cgid.ContextWithProblemDetails(r.Context())))
+	})
+}
+
 func LogWithIdentifier(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := rand.String(5)
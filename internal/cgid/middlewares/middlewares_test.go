@@ -0,0 +1,207 @@
+package middlewares_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/middlewares"
+	"github.com/xdavidwu/kube-cgi/internal/schema"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string"},
+		"age": {"type": "integer", "minimum": 0}
+	}
+}`
+
+func validate(t *testing.T, h http.Handler, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	return w
+}
+
+func stack(t *testing.T, s *jsonschema.Schema, output kubecgiv1alpha1.ValidationOutput) http.Handler {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		t.Error("invalid request passed through")
+	})
+	return middlewares.LogWithIdentifier(middlewares.DrainBody(
+		middlewares.ValidateJson(next, s, output)))
+}
+
+func locations(details []cgid.Detail) map[string]string {
+	l := map[string]string{}
+	for _, d := range details {
+		l[d.InstanceLocation] = d.KeywordLocation
+	}
+	return l
+}
+
+func TestValidateJsonBasic(t *testing.T) {
+	s, err := schema.CompileString(testSchema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := validate(t, stack(t, s, kubecgiv1alpha1.ValidationOutputBasic), `{"name": 1, "age": -1}`)
+
+	var res cgid.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot decode body: %v", err)
+	}
+	if res.Message != "request body does not match schema" {
+		t.Errorf("unexpected message %q", res.Message)
+	}
+	l := locations(res.Errors)
+	if l["/name"] != "/properties/name/type" || l["/age"] != "/properties/age/minimum" {
+		t.Errorf("unexpected errors %+v", res.Errors)
+	}
+	for _, d := range res.Errors {
+		if d.Message == "" || len(d.Errors) != 0 {
+			t.Errorf("unexpected basic output unit %+v", d)
+		}
+	}
+}
+
+func TestValidateJsonDetailed(t *testing.T) {
+	s, err := schema.CompileString(testSchema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := validate(t, stack(t, s, kubecgiv1alpha1.ValidationOutputDetailed), `{"name": 1, "age": -1}`)
+
+	var res cgid.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot decode body: %v", err)
+	}
+	var leaves []cgid.Detail
+	var walk func([]cgid.Detail)
+	walk = func(details []cgid.Detail) {
+		for _, d := range details {
+			if len(d.Errors) == 0 {
+				leaves = append(leaves, d)
+			}
+			walk(d.Errors)
+		}
+	}
+	walk(res.Errors)
+	l := locations(leaves)
+	if l["/name"] != "/properties/name/type" || l["/age"] != "/properties/age/minimum" {
+		t.Errorf("unexpected errors %+v", res.Errors)
+	}
+}
+
+func TestValidateJsonFlag(t *testing.T) {
+	s, err := schema.CompileString(testSchema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := validate(t, stack(t, s, kubecgiv1alpha1.ValidationOutputFlag), `{"name": 1}`)
+
+	var res cgid.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot decode body: %v", err)
+	}
+	if len(res.Errors) != 0 || strings.Contains(res.Message, "/name") {
+		t.Errorf("schema revealed in %+v", res)
+	}
+}
+
+func TestValidateJsonProblemDetails(t *testing.T) {
+	s, err := schema.CompileString(testSchema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := middlewares.WithProblemDetails(stack(t, s, kubecgiv1alpha1.ValidationOutputBasic))
+	w := validate(t, h, `{"name": 1, "age": -1}`)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	var p cgid.ProblemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("cannot decode body: %v", err)
+	}
+	if p.Status != http.StatusUnprocessableEntity || p.Instance == "" || p.Class != cgid.ClassRequest {
+		t.Errorf("unexpected problem details %+v", p)
+	}
+	l := locations(p.Errors)
+	if _, ok := l["/name"]; !ok {
+		t.Errorf("missing error at /name, got %+v", p.Errors)
+	}
+	if _, ok := l["/age"]; !ok {
+		t.Errorf("missing error at /age, got %+v", p.Errors)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	maxAge := int32(600)
+	dispatched := false
+	h := middlewares.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dispatched = true
+		w.Header().Set("Access-Control-Expose-Headers", "X-Script")
+		w.WriteHeader(http.StatusOK)
+	}), &kubecgiv1alpha1.CORS{
+		AllowOrigins:     []string{"https://example.com"},
+		AllowHeaders:     []string{"Content-Type"},
+		ExposeHeaders:    []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAgeSeconds:    &maxAge,
+	}, []string{http.MethodGet, http.MethodPost})
+
+	r := httptest.NewRequest(http.MethodOptions, "/", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if dispatched || w.Code != http.StatusNoContent {
+		t.Fatalf("expected preflight answered with 204 without dispatching, got %d", w.Code)
+	}
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Content-Type",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if w.Header().Get(k) != v {
+			t.Errorf("preflight: expected %s %q, got %q", k, v, w.Header().Get(k))
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Origin", "https://example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !dispatched {
+		t.Fatal("expected actual request dispatched")
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("expected origin allowed, got %v", w.Header())
+	}
+	if w.Header().Get("Access-Control-Expose-Headers") != "X-Script" {
+		t.Errorf("expected headers of script kept, got %v", w.Header())
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected Vary: Origin, got %v", w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Origin", "https://other.example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected other origin not allowed, got %v", w.Header())
+	}
+}
@@ -0,0 +1,177 @@
+package routing
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/middlewares"
+)
+
+// of each path, with host if restricted, among APIs of it; those without
+// hosts also serve paths with hosts not matched by ones with
+func allowed(apis []kubecgiv1alpha1.API) map[string]string {
+	byHostPath := map[string]map[string]bool{}
+	add := func(hostPath string, api *kubecgiv1alpha1.API) {
+		methods := byHostPath[hostPath]
+		if methods == nil {
+			methods = map[string]bool{http.MethodOptions: true}
+			byHostPath[hostPath] = methods
+		}
+		for _, method := range api.ServedMethods() {
+			methods[method] = true
+		}
+	}
+	for i := range apis {
+		for _, hostPath := range apis[i].HostPaths() {
+			add(hostPath, &apis[i])
+		}
+	}
+	for i := range apis {
+		if len(apis[i].Hosts) != 0 {
+			continue
+		}
+		for j := range apis {
+			if len(apis[j].Hosts) != 0 && apis[j].Path == apis[i].Path {
+				for _, hostPath := range apis[j].HostPaths() {
+					add(hostPath, &apis[i])
+				}
+			}
+		}
+	}
+
+	allow := map[string]string{}
+	for hostPath, methods := range byHostPath {
+		list := []string{}
+		for method := range methods {
+			list = append(list, method)
+		}
+		slices.Sort(list)
+		allow[hostPath] = strings.Join(list, ", ")
+	}
+	return allow
+}
+
+// answers OPTIONS, and others with 405, without dispatching
+func implicit(allow string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		cgid.WriteError(w, r, http.StatusMethodNotAllowed, "")
+	})
+}
+
+// HEAD is also matched by GET, and OPTIONS by patterns without methods;
+// preflights are left to CORS middleware, if any
+func withImplicit(next http.Handler, api *kubecgiv1alpha1.API, allow string, cors bool) http.Handler {
+	h := implicit(allow)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == http.MethodHead || r.Method == http.MethodOptions) &&
+			!slices.Contains(api.Methods, r.Method) &&
+			!(cors && middlewares.IsPreflight(r)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// on paths only served with other methods, passes preflights to the API
+// serving the requested method, if it has CORS policy
+func withPreflight(next http.Handler, preflights map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if middlewares.IsPreflight(r) {
+			if h, ok := preflights[r.Header.Get("Access-Control-Request-Method")]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pattern without method
+func hostPathOf(pattern string) string {
+	if _, hostPath, ok := strings.Cut(pattern, " "); ok {
+		return hostPath
+	}
+	return pattern
+}
+
+// Register registers handlers of APIs on mux by their patterns, with HEAD and
+// OPTIONS answered without dispatching unless listed
+func Register(mux *http.ServeMux, spec *kubecgiv1alpha1.APISetSpec, handlers []http.Handler) {
+	allow := allowed(spec.APIs)
+	// by path with host if restricted, then requested method
+	preflights := map[string]map[string]http.Handler{}
+	for i := range spec.APIs {
+		api := &spec.APIs[i]
+		cors := spec.CORSFor(api) != nil
+		byHostPath := map[string]http.Handler{}
+		for _, hostPath := range api.HostPaths() {
+			h := withImplicit(handlers[i], api, allow[hostPath], cors)
+			byHostPath[hostPath] = h
+			if cors {
+				if preflights[hostPath] == nil {
+					preflights[hostPath] = map[string]http.Handler{}
+				}
+				for _, method := range api.ServedMethods() {
+					preflights[hostPath][method] = h
+				}
+			}
+		}
+		for _, pattern := range api.Patterns() {
+			mux.Handle(pattern, byHostPath[hostPathOf(pattern)])
+		}
+	}
+	for _, pattern := range spec.OptionsPatterns() {
+		hostPath := hostPathOf(pattern)
+		methods := map[string]http.Handler{}
+		if path := hostPath[strings.Index(hostPath, "/"):]; path != hostPath {
+			// of those without hosts, if not matched with hosts
+			maps.Copy(methods, preflights[path])
+		}
+		maps.Copy(methods, preflights[hostPath])
+		mux.Handle(pattern, withPreflight(implicit(allow[hostPath]), methods))
+	}
+}
+
+// writes errors generated by net/http.ServeMux in our formats
+type muxErrorWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	discarded bool
+}
+
+func (w *muxErrorWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusNotFound || statusCode == http.StatusMethodNotAllowed {
+		cgid.WriteError(w.ResponseWriter, w.r, statusCode, "")
+		w.discarded = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *muxErrorWriter) Write(b []byte) (int, error) {
+	if w.discarded {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Handler serves mux, with its 404 and 405 responses, e.g. of methods not
+// served, in our error formats
+func Handler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &muxErrorWriter{ResponseWriter: w, r: r}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
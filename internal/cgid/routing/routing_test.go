@@ -0,0 +1,162 @@
+package routing_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+	"github.com/xdavidwu/kube-cgi/internal/cgid/routing"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Handler", name)
+	})
+}
+
+func TestRegister(t *testing.T) {
+	spec := &kubecgiv1alpha1.APISetSpec{
+		APIs: []kubecgiv1alpha1.API{
+			{Path: "/items/{id}", Methods: []string{http.MethodGet}},
+			{Path: "/items/{id}", Methods: []string{http.MethodPost, http.MethodHead}},
+			{Path: "/any"},
+		},
+	}
+	mux := &http.ServeMux{}
+	routing.Register(mux, spec, []http.Handler{named("get"), named("post"), named("any")})
+	h := routing.Handler(mux)
+
+	for _, c := range []struct {
+		method, path string
+		handler      string
+		status       int
+		allow        string
+	}{
+		{http.MethodGet, "/items/1", "get", http.StatusOK, ""},
+		{http.MethodPost, "/items/1", "post", http.StatusOK, ""},
+		{http.MethodHead, "/items/1", "post", http.StatusOK, ""},
+		{http.MethodDelete, "/items/1", "", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST"},
+		{http.MethodOptions, "/items/1", "", http.StatusNoContent, "GET, HEAD, OPTIONS, POST"},
+		{http.MethodPut, "/any", "any", http.StatusOK, ""},
+		{http.MethodHead, "/any", "", http.StatusMethodNotAllowed, "DELETE, GET, OPTIONS, PATCH, POST, PUT"},
+		{http.MethodOptions, "/any", "", http.StatusNoContent, "DELETE, GET, OPTIONS, PATCH, POST, PUT"},
+		{http.MethodGet, "/missing", "", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.status || w.Header().Get("X-Handler") != c.handler {
+			t.Errorf("%s %s: expected %d by %q, got %d by %q",
+				c.method, c.path, c.status, c.handler, w.Code, w.Header().Get("X-Handler"))
+		}
+		if c.allow != "" && w.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s: expected Allow %s, got %s", c.method, c.path, c.allow, w.Header().Get("Allow"))
+		}
+		if c.status >= 400 {
+			var res cgid.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Errorf("%s %s: error not in our format: %q", c.method, c.path, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestMuxMethodNotAllowed(t *testing.T) {
+	spec := &kubecgiv1alpha1.APISetSpec{
+		APIs: []kubecgiv1alpha1.API{
+			{Path: "/items/", Methods: []string{http.MethodPost}},
+		},
+	}
+	mux := &http.ServeMux{}
+	routing.Register(mux, spec, []http.Handler{named("post")})
+	// generated by the mux itself, as the pattern is more specific
+	mux.Handle(http.MethodGet+" /items/{id}", named("get"))
+
+	w := httptest.NewRecorder()
+	routing.Handler(mux).ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/items/1", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Errorf("expected 405 with Allow, got %d %v", w.Code, w.Header())
+	}
+	var res cgid.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Errorf("error not in our format: %q", w.Body.String())
+	}
+}
+
+func TestRegisterPreflight(t *testing.T) {
+	spec := &kubecgiv1alpha1.APISetSpec{
+		CORS: &kubecgiv1alpha1.CORS{AllowOrigins: []string{"*"}},
+		APIs: []kubecgiv1alpha1.API{
+			{Path: "/items/{id}", Methods: []string{http.MethodGet}},
+			{Path: "/items/{id}", Methods: []string{http.MethodPost}, CORS: &kubecgiv1alpha1.CORS{
+				AllowOrigins: []string{"https://example.com"},
+			}},
+			{Path: "/any"},
+		},
+	}
+	mux := &http.ServeMux{}
+	routing.Register(mux, spec, []http.Handler{named("get"), named("post"), named("any")})
+	h := routing.Handler(mux)
+
+	for _, c := range []struct {
+		path, method string
+		handler      string
+	}{
+		{"/items/1", http.MethodGet, "get"},
+		{"/items/1", http.MethodPost, "post"},
+		{"/items/1", http.MethodDelete, ""},
+		{"/any", http.MethodPut, "any"},
+	} {
+		r := httptest.NewRequest(http.MethodOptions, c.path, nil)
+		r.Header.Set("Origin", "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", c.method)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("X-Handler") != c.handler {
+			t.Errorf("preflight of %s %s: expected handled by %q, got %q",
+				c.method, c.path, c.handler, w.Header().Get("X-Handler"))
+		}
+	}
+}
+
+func TestRegisterHosts(t *testing.T) {
+	spec := &kubecgiv1alpha1.APISetSpec{
+		Host:  "api.example.com",
+		Hosts: []string{"api.internal.example.com"},
+		APIs: []kubecgiv1alpha1.API{
+			{Path: "/items/{id}", Methods: []string{http.MethodGet}},
+			{Path: "/items/{id}", Methods: []string{http.MethodDelete}, Hosts: []string{"api.internal.example.com"}},
+			{Path: "/admin", Hosts: []string{"api.internal.example.com"}},
+		},
+	}
+	mux := &http.ServeMux{}
+	routing.Register(mux, spec, []http.Handler{named("get"), named("delete"), named("admin")})
+	h := routing.Handler(mux)
+
+	for _, c := range []struct {
+		method, url string
+		handler     string
+		status      int
+		allow       string
+	}{
+		{http.MethodGet, "http://api.example.com/items/1", "get", http.StatusOK, ""},
+		{http.MethodGet, "http://api.internal.example.com/items/1", "get", http.StatusOK, ""},
+		{http.MethodDelete, "http://api.internal.example.com/items/1", "delete", http.StatusOK, ""},
+		{http.MethodDelete, "http://api.example.com/items/1", "", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodOptions, "http://api.internal.example.com/items/1", "", http.StatusNoContent, "DELETE, GET, OPTIONS"},
+		{http.MethodPost, "http://api.internal.example.com/admin", "admin", http.StatusOK, ""},
+		{http.MethodPost, "http://api.example.com/admin", "", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.status || w.Header().Get("X-Handler") != c.handler {
+			t.Errorf("%s %s: expected %d by %q, got %d by %q",
+				c.method, c.url, c.status, c.handler, w.Code, w.Header().Get("X-Handler"))
+		}
+		if c.allow != "" && w.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s: expected Allow %s, got %s", c.method, c.url, c.allow, w.Header().Get("Allow"))
+		}
+	}
+}
@@ -9,7 +9,13 @@ import (
 )
 
 const (
-	BodyEnvKey = "REQUEST_BODY"
+	BodyEnvKey      = "REQUEST_BODY"
+	ArtifactsEnvKey = "ARTIFACTS_URL"
+	FormEnvPrefix   = "FORM_"
+
+	ArtifactsHeader = "X-KubeCGI-Artifacts"
+	PodHeader       = "X-KubeCGI-Pod"
+	PhaseHeader     = "X-KubeCGI-Phase"
 )
 
 var (
@@ -29,6 +35,8 @@ type ctxKey string
 var (
 	ctxBody = ctxKey("body")
 	ctxId   = ctxKey("id")
+
+	ctxProblemDetails = ctxKey("problem-details")
 )
 
 func ContextWithId(ctx context.Context, id string) context.Context {
@@ -39,6 +47,11 @@ func ContextWithBody(ctx context.Context, body []byte) context.Context {
 	return context.WithValue(ctx, ctxBody, body)
 }
 
+// ContextWithProblemDetails makes errors responded in RFC 9457 Problem Details
+func ContextWithProblemDetails(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxProblemDetails, true)
+}
+
 func IdFromContext(ctx context.Context) string {
 	return ctx.Value(ctxId).(string)
 }
@@ -48,19 +61,66 @@ func BodyFromContext(ctx context.Context) []byte {
 }
 
 type ErrorResponse struct {
-	Message string `json:"error"`
+	Message   string   `json:"error"`
+	RequestID string   `json:"requestId,omitempty"`
+	Errors    []Detail `json:"errors,omitempty"`
 }
 
-func WriteError(w http.ResponseWriter, statusCode int, msg string) error {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+// RFC 9457, with extension members
+type ProblemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
 
+	Class  string   `json:"class"`
+	Errors []Detail `json:"errors,omitempty"`
+}
+
+// WriteError responds with an error of the status, classified by it
+func WriteError(w http.ResponseWriter, r *http.Request, statusCode int, msg string) error {
+	class := ClassInternal
+	if statusCode < 500 {
+		class = ClassRequest
+	}
+	return WriteErrorFrom(w, r, &Error{Status: statusCode, Class: class, Message: msg})
+}
+
+// WriteErrorFrom responds with err, mapped by FromKubernetes if not an *Error
+func WriteErrorFrom(w http.ResponseWriter, r *http.Request, err error) error {
+	e := FromKubernetes(err)
+	errorsTotal.WithLabelValues(e.Class).Inc()
+
+	msg := e.Message
 	if msg == "" {
-		msg = strings.ToLower(http.StatusText(statusCode))
+		msg = strings.ToLower(http.StatusText(e.Status))
+	}
+
+	// may be before an id is assigned
+	id, _ := r.Context().Value(ctxId).(string)
+
+	var body []byte
+	if problem, _ := r.Context().Value(ctxProblemDetails).(bool); problem {
+		w.Header().Set("Content-Type", "application/problem+json")
+		p := ProblemDetails{
+			// as no more semantics than the status, see class instead
+			Type:   "about:blank",
+			Title:  http.StatusText(e.Status),
+			Status: e.Status,
+			Detail: e.Message,
+			// a relative URI reference
+			Instance: id,
+			Class:    e.Class,
+			Errors:   e.Details,
+		}
+		body, _ = json.Marshal(p)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(ErrorResponse{Message: msg, RequestID: id, Errors: e.Details})
 	}
 
-	m := ErrorResponse{Message: msg}
-	body, _ := json.Marshal(m)
-	_, err := w.Write(body)
+	w.WriteHeader(e.Status)
+	_, err = w.Write(body)
 	return err
 }
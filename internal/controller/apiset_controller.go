@@ -2,6 +2,9 @@ package controller
 
 import (
 	"context"
+	"maps"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -10,18 +13,23 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/tools/reference"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
 	"github.com/xdavidwu/kube-cgi/internal"
+	"github.com/xdavidwu/kube-cgi/internal/openapi"
+	"github.com/xdavidwu/kube-cgi/internal/schema"
 )
 
 // APISetReconciler reconciles a APISet object
@@ -36,13 +44,15 @@ type APISetReconciler struct {
 //+kubebuilder:rbac:groups=kube-cgi.aic.cs.nycu.edu.tw,resources=apisets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=kube-cgi.aic.cs.nycu.edu.tw,resources=apisets/finalizers,verbs=update
 
-//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=list;watch;create;patch
-//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=list;watch;create;patch
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=list;watch;create;patch
-//+kubebuilder:rbac:groups="",resources=services,verbs=list;watch;create;patch
-//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=list;watch;create;patch
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=list;watch;get;create;patch
-//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups="",resources=services,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=list;watch;get;create;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors,verbs=list;watch;create;patch;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=list;watch;create;patch;delete
 
 // rbac in internal/cgid is also set on manager to be able to bind
 
@@ -52,6 +62,13 @@ const (
 	managedByManager = fieldManager
 	metricsPortName  = "metrics"
 	httpPortName     = "http"
+
+	claimVolumeNamePrefix = "claim-"
+	tlsSecretSuffix       = "-tls"
+
+	certManagerIssuerKey         = "cert-manager.io/issuer"
+	certManagerClusterIssuerKey  = "cert-manager.io/cluster-issuer"
+	certManagerClusterIssuerKind = "ClusterIssuer"
 )
 
 var (
@@ -83,11 +100,11 @@ func pathSpecToRule(p string) (string, networkingv1.PathType) {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.16.0/pkg/reconcile
-func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
 	log := log.FromContext(ctx)
 
 	var apiSet kubecgiv1alpha1.APISet
-	err := r.Get(ctx, req.NamespacedName, &apiSet)
+	err = r.Get(ctx, req.NamespacedName, &apiSet)
 	if err != nil {
 		err = client.IgnoreNotFound(err)
 		if err != nil {
@@ -143,10 +160,6 @@ func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 									Name:  internal.KcgidEnvAPISetName,
 									Value: req.Name,
 								},
-								{
-									Name:  internal.KcgidEnvAPISetGeneration,
-									Value: strconv.FormatInt(apiSet.ObjectMeta.Generation, 10),
-								},
 							},
 							ReadinessProbe: &corev1.Probe{
 								ProbeHandler: corev1.ProbeHandler{
@@ -163,8 +176,50 @@ func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 			},
 		},
 	}
-	if apiSet.Spec.Kcgid != nil && *apiSet.Spec.Kcgid.Replicas != 0 {
-		deployment.Spec.Replicas = apiSet.Spec.Kcgid.Replicas
+	if k := apiSet.Spec.Kcgid; k != nil {
+		if *k.Replicas != 0 {
+			deployment.Spec.Replicas = k.Replicas
+		}
+
+		// required env are kept, as names of them are rejected by webhook
+		container := &deployment.Spec.Template.Spec.Containers[0]
+		container.Env = append(container.Env, k.Env...)
+		container.Resources = k.Resources
+		container.SecurityContext = k.SecurityContext
+
+		podSpec := &deployment.Spec.Template.Spec
+		podSpec.SecurityContext = k.PodSecurityContext
+		podSpec.NodeSelector = k.NodeSelector
+		podSpec.Tolerations = k.Tolerations
+		podSpec.Affinity = k.Affinity
+		podSpec.TopologySpreadConstraints = k.TopologySpreadConstraints
+		podSpec.PriorityClassName = k.PriorityClassName
+	}
+	claimMounts := map[string]string{}
+	if s := apiSet.Spec.ArtifactStorage; s != nil && s.PersistentVolumeClaim != nil {
+		claimMounts[internal.KcgidArtifactsMountPath] = s.PersistentVolumeClaim.ClaimName
+	}
+	for _, api := range apiSet.Spec.APIs {
+		if api.Request != nil && api.Request.Form != nil && api.Request.Form.PersistentVolumeClaim != nil {
+			name := api.Request.Form.PersistentVolumeClaim.ClaimName
+			claimMounts[path.Join(internal.KcgidFormsMountPath, name)] = name
+		}
+	}
+	mountPaths := slices.Sorted(maps.Keys(claimMounts))
+	for i, mountPath := range mountPaths {
+		volumeName := claimVolumeNamePrefix + strconv.Itoa(i)
+		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: claimMounts[mountPath],
+				},
+			},
+		})
+		deployment.Spec.Template.Spec.Containers[0].VolumeMounts = append(deployment.Spec.Template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: mountPath,
+		})
 	}
 
 	service := corev1.Service{
@@ -187,35 +242,91 @@ func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		},
 	}
 
+	backend := networkingv1.IngressBackend{
+		Service: &networkingv1.IngressServiceBackend{
+			Name: req.Name,
+			Port: networkingv1.ServiceBackendPort{
+				Number: 80,
+			},
+		},
+	}
 	paths := make([]networkingv1.HTTPIngressPath, len(apiSet.Spec.APIs))
 	for i := range apiSet.Spec.APIs {
 		path, pathType := pathSpecToRule(apiSet.Spec.APIs[i].Path)
 		paths[i] = networkingv1.HTTPIngressPath{
 			Path:     path,
 			PathType: &pathType,
-			Backend: networkingv1.IngressBackend{
-				Service: &networkingv1.IngressServiceBackend{
-					Name: req.Name,
-					Port: networkingv1.ServiceBackendPort{
-						Number: 80,
-					},
-				},
-			},
+			Backend:  backend,
 		}
 	}
+	openAPIPathType := networkingv1.PathTypeExact
+	paths = append(paths, networkingv1.HTTPIngressPath{
+		Path:     internal.KcgidOpenAPIEndpointPath,
+		PathType: &openAPIPathType,
+		Backend:  backend,
+	})
+	if apiSet.Spec.ArtifactStorage != nil {
+		pathType := networkingv1.PathTypePrefix
+		paths = append(paths, networkingv1.HTTPIngressPath{
+			Path:     strings.TrimSuffix(internal.KcgidArtifactsEndpointPath, "/"),
+			PathType: &pathType,
+			Backend:  backend,
+		})
+	}
+	hosts := apiSet.Spec.AllHosts()
+	ingressSpec := apiSet.Spec.Ingress
+	if ingressSpec == nil {
+		ingressSpec = &kubecgiv1alpha1.Ingress{}
+	}
 	ingress := networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      maps.Clone(ingressSpec.Labels),
+			Annotations: maps.Clone(ingressSpec.Annotations),
+		},
 		Spec: networkingv1.IngressSpec{
-			Rules: []networkingv1.IngressRule{
-				{
-					Host: apiSet.Spec.Host,
-					IngressRuleValue: networkingv1.IngressRuleValue{
-						HTTP: &networkingv1.HTTPIngressRuleValue{
-							Paths: paths,
-						},
-					},
+			IngressClassName: ingressSpec.ClassName,
+		},
+	}
+	for _, host := range hosts {
+		ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: paths,
 				},
 			},
-		},
+		})
+	}
+	if tls := ingressSpec.TLS; tls != nil {
+		secretName := tls.SecretName
+		if secretName == "" {
+			secretName = req.Name + tlsSecretSuffix
+		}
+		ingress.Spec.TLS = []networkingv1.IngressTLS{
+			{
+				Hosts:      hosts,
+				SecretName: secretName,
+			},
+		}
+		if tls.Issuer != nil {
+			if ingress.Annotations == nil {
+				ingress.Annotations = map[string]string{}
+			}
+			key := certManagerIssuerKey
+			if tls.Issuer.Kind == certManagerClusterIssuerKind {
+				key = certManagerClusterIssuerKey
+			}
+			ingress.Annotations[key] = tls.Issuer.Name
+		}
+	}
+
+	doc, err := openapi.Build(&apiSet, schema.ConfigMapsFrom(ctx, r.Client, req.Namespace))
+	if err != nil {
+		log.Error(err, "cannot build openapi document")
+		return ctrl.Result{}, err
+	}
+	configMap := corev1.ConfigMap{
+		Data: map[string]string{internal.OpenAPIConfigMapKey: string(doc)},
 	}
 
 	type resource struct {
@@ -228,7 +339,19 @@ func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		{&roleBinding, &apiSet.Status.RoleBinding},
 		{&deployment, &apiSet.Status.Deployment},
 		{&service, &apiSet.Status.Service},
-		{&ingress, &apiSet.Status.Ingress},
+		{&configMap, &apiSet.Status.OpenAPI},
+	}
+
+	var route *unstructured.Unstructured
+	if apiSet.Spec.Gateway != nil {
+		route = buildHTTPRoute(&apiSet, req.Name)
+		resources = append(resources, resource{route, &apiSet.Status.HTTPRoute})
+	}
+
+	var appliedIngress *networkingv1.Ingress
+	if route == nil && !ingressSpec.Disabled {
+		appliedIngress = &ingress
+		resources = append(resources, resource{&ingress, &apiSet.Status.Ingress})
 	}
 
 	// XXX
@@ -262,6 +385,9 @@ func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	apiSet.Status.ObservedGeneration = apiSet.ObjectMeta.Generation
 	defer func() {
+		if err != nil {
+			setReconcileFailedConditions(&apiSet, err)
+		}
 		err2 := r.Status().Update(ctx, &apiSet)
 		if err2 != nil {
 			log.Error(err2, "cannot update status", "status", apiSet.Status)
@@ -324,22 +450,80 @@ func (r *APISetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 	}
 
+	desired := make([]client.Object, len(resources))
+	for i, res := range resources {
+		desired[i] = res.obj
+	}
+	err = r.collectGarbage(ctx, &apiSet, desired)
+	if err != nil {
+		log.Error(err, "cannot delete objects no longer desired")
+		return ctrl.Result{}, err
+	}
+	for _, ref := range []**corev1.ObjectReference{
+		&apiSet.Status.Ingress,
+		&apiSet.Status.HTTPRoute,
+		&apiSet.Status.ImagePullSecret,
+		&apiSet.Status.ServiceMonitor,
+	} {
+		if !slices.ContainsFunc(resources, func(res resource) bool { return res.statusRef == ref }) {
+			*ref = nil
+		}
+	}
+
+	setDeploymentConditions(&apiSet, &deployment)
+	setIngressReadyCondition(&apiSet, appliedIngress)
+	setRouteAcceptedCondition(&apiSet, route)
+	setReadyCondition(&apiSet, &deployment)
+
 	soTrue := true
 	apiSet.Status.Deployed = &soTrue
 	return ctrl.Result{}, err
 }
 
+// watches owned objects also of optional CRDs, if served at startup
+func ownsIfServed(b *builder.Builder, mgr ctrl.Manager, obj client.Object) (*builder.Builder, error) {
+	gvk, err := apiutil.GVKForObject(obj, mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	_, err = mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return b.Owns(obj), nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *APISetReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	// TODO also watch servicemonitor if supported
-	return ctrl.NewControllerManagedBy(mgr).
+	// labels and annotations are propagated to owned objects, which are
+	// reconciled on any changes including those not by us
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&kubecgiv1alpha1.APISet{},
-			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+			builder.WithPredicates(predicate.Or(
+				predicate.GenerationChangedPredicate{},
+				predicate.LabelChangedPredicate{},
+				predicate.AnnotationChangedPredicate{},
+			))).
 		Owns(&corev1.ServiceAccount{}).
 		Owns(&rbacv1.RoleBinding{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
 		Owns(&networkingv1.Ingress{}).
 		Owns(&corev1.Secret{}).
-		Complete(r)
+		Owns(&corev1.ConfigMap{})
+
+	b, err := ownsIfServed(b, mgr, &monitoringv1.ServiceMonitor{})
+	if err != nil {
+		return err
+	}
+	// also on status changes, to reflect acceptance
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(httpRouteGVK)
+	b, err = ownsIfServed(b, mgr, route)
+	if err != nil {
+		return err
+	}
+	return b.Complete(r)
 }
@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal"
+)
+
+func buildAPISet(namespace, name string) *kubecgiv1alpha1.APISet {
+	return &kubecgiv1alpha1.APISet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: kubecgiv1alpha1.APISetSpec{
+			Host: "example.local",
+			APIs: []kubecgiv1alpha1.API{
+				{
+					Path: "/test",
+					PodSpec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Name:  "test",
+								Image: "alpine:latest",
+							},
+						},
+						RestartPolicy: corev1.RestartPolicyNever,
+					},
+				},
+			},
+		},
+	}
+}
+
+var _ = Describe("APISet controller", Ordered, func() {
+	const timeout, interval = 10 * time.Second, 100 * time.Millisecond
+	apiSet := buildAPISet(managedNamespace, "watched")
+	key := client.ObjectKeyFromObject(apiSet)
+
+	BeforeAll(func(ctx SpecContext) {
+		Expect(k8sClient.Create(ctx, apiSet)).To(Succeed())
+		Eventually(func() error {
+			return k8sClient.Get(ctx, key, &appsv1.Deployment{})
+		}, timeout, interval).Should(Succeed())
+	})
+
+	It("repairs manual edits of owned objects", func(ctx SpecContext) {
+		deployment := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, key, deployment)).To(Succeed())
+		deployment.Spec.Template.Spec.Containers[0].Image = "edited:latest"
+		Expect(k8sClient.Update(ctx, deployment)).To(Succeed())
+
+		Eventually(func() string {
+			Expect(k8sClient.Get(ctx, key, deployment)).To(Succeed())
+			return deployment.Spec.Template.Spec.Containers[0].Image
+		}, timeout, interval).Should(Equal(testKcgidImage))
+	})
+
+	It("propagates labels of the APISet", func(ctx SpecContext) {
+		Expect(k8sClient.Get(ctx, key, apiSet)).To(Succeed())
+		apiSet.Labels = map[string]string{"team": "test"}
+		Expect(k8sClient.Update(ctx, apiSet)).To(Succeed())
+
+		Eventually(func() map[string]string {
+			service := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, key, service)).To(Succeed())
+			return service.Labels
+		}, timeout, interval).Should(HaveKeyWithValue("team", "test"))
+	})
+
+	It("reflects status of owned objects", func(ctx SpecContext) {
+		deployment := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, key, deployment)).To(Succeed())
+		deployment.Status = appsv1.DeploymentStatus{
+			ObservedGeneration: deployment.Generation,
+			Replicas:           1,
+			UpdatedReplicas:    1,
+			ReadyReplicas:      1,
+			AvailableReplicas:  1,
+			Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue, Reason: "MinimumReplicasAvailable"},
+				{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionTrue, Reason: "NewReplicaSetAvailable"},
+			},
+		}
+		Expect(k8sClient.Status().Update(ctx, deployment)).To(Succeed())
+
+		ingress := &networkingv1.Ingress{}
+		Expect(k8sClient.Get(ctx, key, ingress)).To(Succeed())
+		ingress.Status.LoadBalancer.Ingress = []networkingv1.IngressLoadBalancerIngress{{IP: "192.0.2.1"}}
+		Expect(k8sClient.Status().Update(ctx, ingress)).To(Succeed())
+
+		Eventually(func() bool {
+			Expect(k8sClient.Get(ctx, key, apiSet)).To(Succeed())
+			return meta.IsStatusConditionTrue(apiSet.Status.Conditions, kubecgiv1alpha1.ConditionReady)
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("recreates deleted ServiceMonitors", func(ctx SpecContext) {
+		Expect(k8sClient.Get(ctx, key, apiSet)).To(Succeed())
+		apiSet.Spec.Kcgid = &kubecgiv1alpha1.Kcgid{ServiceMonitor: true}
+		Expect(k8sClient.Update(ctx, apiSet)).To(Succeed())
+
+		serviceMonitor := &monitoringv1.ServiceMonitor{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, key, serviceMonitor)
+		}, timeout, interval).Should(Succeed())
+		uid := serviceMonitor.UID
+
+		Expect(k8sClient.Delete(ctx, serviceMonitor)).To(Succeed())
+		Eventually(func() bool {
+			recreated := &monitoringv1.ServiceMonitor{}
+			return k8sClient.Get(ctx, key, recreated) == nil && recreated.UID != uid
+		}, timeout, interval).Should(BeTrue())
+	})
+})
+
+var _ = Describe("APISet garbage collection", Ordered, func() {
+	apiSet := buildAPISet("default", "gc")
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(apiSet)}
+	reconciler := &APISetReconciler{
+		Scheme:     scheme.Scheme,
+		KcgidImage: testKcgidImage,
+		PullSecret: &corev1.Secret{
+			Data: map[string][]byte{"test": []byte("test")},
+		},
+	}
+
+	reconcile := func(ctx SpecContext) {
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Get(ctx, req.NamespacedName, apiSet)).To(Succeed())
+	}
+	expectGone := func(ctx SpecContext, obj client.Object) {
+		err := k8sClient.Get(ctx, req.NamespacedName, obj)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected not found, got %v", err)
+	}
+
+	BeforeAll(func(ctx SpecContext) {
+		reconciler.Client = k8sClient
+		Expect(k8sClient.Create(ctx, apiSet)).To(Succeed())
+	})
+
+	It("creates owned objects", func(ctx SpecContext) {
+		reconcile(ctx)
+		Expect(apiSet.Status.Ingress).NotTo(BeNil())
+		Expect(apiSet.Status.ImagePullSecret).NotTo(BeNil())
+		Expect(k8sClient.Get(ctx, req.NamespacedName, &networkingv1.Ingress{})).To(Succeed())
+		Expect(k8sClient.Get(ctx, req.NamespacedName, &corev1.Secret{})).To(Succeed())
+	})
+
+	It("deletes the ingress when disabled", func(ctx SpecContext) {
+		apiSet.Spec.Ingress = &kubecgiv1alpha1.Ingress{Disabled: true}
+		Expect(k8sClient.Update(ctx, apiSet)).To(Succeed())
+		reconcile(ctx)
+		Expect(apiSet.Status.Ingress).To(BeNil())
+		expectGone(ctx, &networkingv1.Ingress{})
+	})
+
+	It("deletes the pull secret when no longer used", func(ctx SpecContext) {
+		reconciler.PullSecret = nil
+		reconcile(ctx)
+		Expect(apiSet.Status.ImagePullSecret).To(BeNil())
+		expectGone(ctx, &corev1.Secret{})
+	})
+
+	It("deletes the ServiceMonitor when turned off", func(ctx SpecContext) {
+		apiSet.Spec.Kcgid = &kubecgiv1alpha1.Kcgid{ServiceMonitor: true}
+		Expect(k8sClient.Update(ctx, apiSet)).To(Succeed())
+		reconcile(ctx)
+		Expect(apiSet.Status.ServiceMonitor).NotTo(BeNil())
+
+		apiSet.Spec.Kcgid.ServiceMonitor = false
+		Expect(k8sClient.Update(ctx, apiSet)).To(Succeed())
+		reconcile(ctx)
+		Expect(apiSet.Status.ServiceMonitor).To(BeNil())
+		expectGone(ctx, &monitoringv1.ServiceMonitor{})
+	})
+
+	It("merges kcgid pod settings into the deployment", func(ctx SpecContext) {
+		apiSet.Spec.Kcgid = &kubecgiv1alpha1.Kcgid{
+			Env:               []corev1.EnvVar{{Name: "EXTRA", Value: "extra"}},
+			NodeSelector:      map[string]string{"kubernetes.io/os": "linux"},
+			Tolerations:       []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}},
+			PriorityClassName: "high",
+		}
+		Expect(k8sClient.Update(ctx, apiSet)).To(Succeed())
+		reconcile(ctx)
+
+		deployment := &appsv1.Deployment{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, deployment)).To(Succeed())
+		podSpec := deployment.Spec.Template.Spec
+		Expect(podSpec.NodeSelector).To(Equal(apiSet.Spec.Kcgid.NodeSelector))
+		Expect(podSpec.Tolerations).To(HaveLen(1))
+		Expect(podSpec.PriorityClassName).To(Equal("high"))
+		container := podSpec.Containers[0]
+		Expect(container.ReadinessProbe).NotTo(BeNil())
+		Expect(container.Env).To(ContainElements(
+			HaveField("Name", internal.KcgidEnvAPISetNamespace),
+			HaveField("Name", internal.KcgidEnvAPISetName),
+			HaveField("Name", "EXTRA"),
+		))
+	})
+
+	It("keeps objects not controlled by the APISet", func(ctx SpecContext) {
+		other := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other",
+				Namespace: apiSet.Namespace,
+				Labels:    map[string]string{managedByKey: managedByManager},
+			},
+		}
+		Expect(k8sClient.Create(ctx, other)).To(Succeed())
+		reconcile(ctx)
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(other), other)).To(Succeed())
+		Expect(k8sClient.Get(ctx, req.NamespacedName, &corev1.ConfigMap{})).To(Succeed())
+	})
+})
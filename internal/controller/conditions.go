@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+const (
+	reasonReconcileFailed          = "ReconcileFailed"
+	reasonRollingOut               = "RollingOut"
+	reasonRolloutComplete          = "RolloutComplete"
+	reasonProgressDeadlineExceeded = "ProgressDeadlineExceeded"
+	reasonReplicasUnavailable      = "ReplicasUnavailable"
+	reasonAsExpected               = "AsExpected"
+	reasonAvailable                = "Available"
+	reasonIngressNotReady          = "IngressNotReady"
+	reasonRouteNotAccepted         = "RouteNotAccepted"
+	reasonLoadBalancerAssigned     = "LoadBalancerAssigned"
+	reasonLoadBalancerPending      = "LoadBalancerPending"
+)
+
+func setCondition(apiSet *kubecgiv1alpha1.APISet, t string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&apiSet.Status.Conditions, metav1.Condition{
+		Type:               t,
+		Status:             status,
+		ObservedGeneration: apiSet.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+func deploymentCondition(d *appsv1.Deployment, t appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range d.Status.Conditions {
+		if d.Status.Conditions[i].Type == t {
+			return &d.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// sets Progressing and Degraded from rollout status of kcgid, where pods
+// are available only if kcgid reports ready with the APISet loaded
+func setDeploymentConditions(apiSet *kubecgiv1alpha1.APISet, d *appsv1.Deployment) {
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+
+	c := deploymentCondition(d, appsv1.DeploymentProgressing)
+	if c != nil && c.Status == corev1.ConditionFalse && c.Reason == "ProgressDeadlineExceeded" {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionProgressing, metav1.ConditionFalse,
+			reasonProgressDeadlineExceeded, c.Message)
+		setCondition(apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionTrue,
+			reasonProgressDeadlineExceeded, c.Message)
+		return
+	}
+
+	// as kubectl rollout status
+	if d.Status.ObservedGeneration < d.Generation || c == nil || c.Reason != "NewReplicaSetAvailable" ||
+		d.Status.UpdatedReplicas < replicas || d.Status.Replicas > d.Status.UpdatedReplicas {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionProgressing, metav1.ConditionTrue, reasonRollingOut,
+			fmt.Sprintf("%d of %d kcgid replicas updated, %d available",
+				d.Status.UpdatedReplicas, replicas, d.Status.AvailableReplicas))
+	} else {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionProgressing, metav1.ConditionFalse, reasonRolloutComplete,
+			"kcgid rolled out")
+	}
+
+	progressing := meta.IsStatusConditionTrue(apiSet.Status.Conditions, kubecgiv1alpha1.ConditionProgressing)
+	if !progressing && d.Status.AvailableReplicas < replicas {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonReplicasUnavailable,
+			fmt.Sprintf("%d of %d kcgid replicas available", d.Status.AvailableReplicas, replicas))
+	} else {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionFalse, reasonAsExpected, "")
+	}
+}
+
+// sets IngressReady from load balancer status, or removes it if not using
+// ingresses
+func setIngressReadyCondition(apiSet *kubecgiv1alpha1.APISet, ingress *networkingv1.Ingress) {
+	if ingress == nil {
+		meta.RemoveStatusCondition(&apiSet.Status.Conditions, kubecgiv1alpha1.ConditionIngressReady)
+		return
+	}
+	if len(ingress.Status.LoadBalancer.Ingress) == 0 {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionIngressReady, metav1.ConditionFalse, reasonLoadBalancerPending,
+			"Waiting for the ingress controller to assign a load balancer")
+		return
+	}
+	setCondition(apiSet, kubecgiv1alpha1.ConditionIngressReady, metav1.ConditionTrue, reasonLoadBalancerAssigned, "")
+}
+
+// sets Ready from other conditions
+func setReadyCondition(apiSet *kubecgiv1alpha1.APISet, d *appsv1.Deployment) {
+	conditions := apiSet.Status.Conditions
+	if c := deploymentCondition(d, appsv1.DeploymentAvailable); c == nil || c.Status != corev1.ConditionTrue {
+		message := "kcgid has not reported ready"
+		if c != nil {
+			message = c.Message
+		}
+		setCondition(apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonReplicasUnavailable, message)
+		return
+	}
+	if c := meta.FindStatusCondition(conditions, kubecgiv1alpha1.ConditionIngressReady); c != nil && c.Status != metav1.ConditionTrue {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonIngressNotReady, c.Message)
+		return
+	}
+	if c := meta.FindStatusCondition(conditions, kubecgiv1alpha1.ConditionRouteAccepted); c != nil && c.Status != metav1.ConditionTrue {
+		setCondition(apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonRouteNotAccepted, c.Message)
+		return
+	}
+	setCondition(apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionTrue, reasonAvailable, "")
+}
+
+// sets conditions on failures, keeping others as last observed
+func setReconcileFailedConditions(apiSet *kubecgiv1alpha1.APISet, err error) {
+	setCondition(apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonReconcileFailed, err.Error())
+	setCondition(apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonReconcileFailed, err.Error())
+}
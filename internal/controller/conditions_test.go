@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+func expectCondition(t *testing.T, apiSet *kubecgiv1alpha1.APISet, conditionType string, status metav1.ConditionStatus, reason string) {
+	t.Helper()
+	c := meta.FindStatusCondition(apiSet.Status.Conditions, conditionType)
+	if c == nil || c.Status != status || c.Reason != reason {
+		t.Errorf("expected %s %s with %s, got %v", conditionType, status, reason, c)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	replicas := int32(2)
+	deployment := func(updated, available int32, conditions ...appsv1.DeploymentCondition) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Generation: 3},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status: appsv1.DeploymentStatus{
+				ObservedGeneration: 3,
+				Replicas:           replicas,
+				UpdatedReplicas:    updated,
+				AvailableReplicas:  available,
+				Conditions:         conditions,
+			},
+		}
+	}
+	available := appsv1.DeploymentCondition{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue}
+	complete := appsv1.DeploymentCondition{
+		Type:   appsv1.DeploymentProgressing,
+		Status: corev1.ConditionTrue,
+		Reason: "NewReplicaSetAvailable",
+	}
+	assigned := &networkingv1.Ingress{Status: networkingv1.IngressStatus{
+		LoadBalancer: networkingv1.IngressLoadBalancerStatus{
+			Ingress: []networkingv1.IngressLoadBalancerIngress{{IP: "192.0.2.1"}},
+		},
+	}}
+
+	t.Run("rolling out", func(t *testing.T) {
+		apiSet := &kubecgiv1alpha1.APISet{}
+		d := deployment(1, 2, available)
+		setDeploymentConditions(apiSet, d)
+		setIngressReadyCondition(apiSet, assigned)
+		setReadyCondition(apiSet, d)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionProgressing, metav1.ConditionTrue, reasonRollingOut)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionFalse, reasonAsExpected)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionTrue, reasonAvailable)
+	})
+
+	t.Run("replicas unavailable", func(t *testing.T) {
+		apiSet := &kubecgiv1alpha1.APISet{}
+		d := deployment(2, 1, available, complete)
+		setDeploymentConditions(apiSet, d)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionProgressing, metav1.ConditionFalse, reasonRolloutComplete)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonReplicasUnavailable)
+	})
+
+	t.Run("progress deadline exceeded", func(t *testing.T) {
+		apiSet := &kubecgiv1alpha1.APISet{}
+		d := deployment(1, 1, appsv1.DeploymentCondition{
+			Type:   appsv1.DeploymentProgressing,
+			Status: corev1.ConditionFalse,
+			Reason: "ProgressDeadlineExceeded",
+		})
+		setDeploymentConditions(apiSet, d)
+		setIngressReadyCondition(apiSet, assigned)
+		setReadyCondition(apiSet, d)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonProgressDeadlineExceeded)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonReplicasUnavailable)
+	})
+
+	t.Run("ingress pending", func(t *testing.T) {
+		apiSet := &kubecgiv1alpha1.APISet{}
+		d := deployment(2, 2, available, complete)
+		setDeploymentConditions(apiSet, d)
+		setIngressReadyCondition(apiSet, &networkingv1.Ingress{})
+		setReadyCondition(apiSet, d)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionProgressing, metav1.ConditionFalse, reasonRolloutComplete)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionIngressReady, metav1.ConditionFalse, reasonLoadBalancerPending)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonIngressNotReady)
+
+		setIngressReadyCondition(apiSet, nil)
+		setReadyCondition(apiSet, d)
+		if meta.FindStatusCondition(apiSet.Status.Conditions, kubecgiv1alpha1.ConditionIngressReady) != nil {
+			t.Error("expected IngressReady removed without ingress")
+		}
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionTrue, reasonAvailable)
+	})
+
+	t.Run("reconcile failed", func(t *testing.T) {
+		apiSet := &kubecgiv1alpha1.APISet{}
+		setReconcileFailedConditions(apiSet, errors.New("forbidden"))
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionDegraded, metav1.ConditionTrue, reasonReconcileFailed)
+		expectCondition(t, apiSet, kubecgiv1alpha1.ConditionReady, metav1.ConditionFalse, reasonReconcileFailed)
+	})
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"slices"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+// kinds of objects owned by APISets, including those of optional CRDs
+var ownedKinds = []schema.GroupVersionKind{
+	corev1.SchemeGroupVersion.WithKind("ServiceAccount"),
+	rbacv1.SchemeGroupVersion.WithKind("RoleBinding"),
+	appsv1.SchemeGroupVersion.WithKind("Deployment"),
+	corev1.SchemeGroupVersion.WithKind("Service"),
+	networkingv1.SchemeGroupVersion.WithKind("Ingress"),
+	httpRouteGVK,
+	corev1.SchemeGroupVersion.WithKind("Secret"),
+	monitoringv1.SchemeGroupVersion.WithKind(monitoringv1.ServiceMonitorsKind),
+	corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+}
+
+// deletes objects managed by us and controlled by the APISet, but not
+// among desired ones, e.g. of features turned off
+func (r *APISetReconciler) collectGarbage(ctx context.Context, apiSet *kubecgiv1alpha1.APISet, desired []client.Object) error {
+	log := log.FromContext(ctx)
+
+	for _, gvk := range ownedKinds {
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		err := r.List(ctx, list, client.InNamespace(apiSet.Namespace),
+			client.MatchingLabels{managedByKey: managedByManager})
+		if meta.IsNoMatchError(err) {
+			// CRD not installed
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for i := range list.Items {
+			obj := &list.Items[i]
+			if !metav1.IsControlledBy(obj, apiSet) ||
+				slices.ContainsFunc(desired, func(d client.Object) bool {
+					return d.GetObjectKind().GroupVersionKind().GroupKind() == gvk.GroupKind() &&
+						d.GetName() == obj.Name
+				}) {
+				continue
+			}
+
+			obj.SetGroupVersionKind(gvk)
+			// not one recreated since listed
+			err = r.Delete(ctx, obj, client.Preconditions{UID: &obj.UID})
+			if client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			log.Info("deleted object no longer desired", "kind", gvk.Kind, "name", obj.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package controller
+
+import (
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal"
+)
+
+// without depending on sigs.k8s.io/gateway-api, as it is optional
+var httpRouteGVK = schema.GroupVersionKind{
+	Group:   "gateway.networking.k8s.io",
+	Version: "v1",
+	Kind:    "HTTPRoute",
+}
+
+// limit of matches in each rule of HTTPRoute
+const httpRouteMaxMatches = 64
+
+const (
+	pathMatchExact             = "Exact"
+	pathMatchPathPrefix        = "PathPrefix"
+	pathMatchRegularExpression = "RegularExpression"
+)
+
+// converts ServeMux path pattern to HTTPRoute path match, as precise as
+// possible
+func pathSpecToMatch(p string) (string, string) {
+	segments := strings.Split(p, "/")
+	wildcard := false
+	for i, s := range segments {
+		if len(s) >= 2 && s[0] == '{' && s[len(s)-1] == '}' {
+			if s == "{$}" {
+				if i == len(segments)-1 && !wildcard {
+					return strings.Join(segments[:i], "/") + "/", pathMatchExact
+				}
+				continue
+			}
+			wildcard = true
+		}
+	}
+	if !wildcard {
+		if strings.HasSuffix(p, "/") {
+			return p, pathMatchPathPrefix
+		}
+		return p, pathMatchExact
+	}
+
+	re := "^"
+	for i, s := range segments {
+		if i != 0 {
+			re += "/"
+		}
+		switch {
+		case s == "{$}":
+			// exact match of trailing slash, nothing to add
+		case len(s) >= 2 && s[0] == '{' && s[len(s)-1] == '}':
+			if strings.HasSuffix(s, "...}") {
+				re += ".*"
+			} else {
+				re += "[^/]+"
+			}
+		case s == "" && i == len(segments)-1:
+			// trailing slash, matching the subtree
+			re += ".*"
+		default:
+			re += regexp.QuoteMeta(s)
+		}
+	}
+	return re + "$", pathMatchRegularExpression
+}
+
+func pathMatch(value, matchType string) map[string]any {
+	return map[string]any{
+		"path": map[string]any{
+			"type":  matchType,
+			"value": value,
+		},
+	}
+}
+
+// builds HTTPRoute routing APIs of the APISet to the service
+func buildHTTPRoute(apiSet *kubecgiv1alpha1.APISet, service string) *unstructured.Unstructured {
+	gateway := apiSet.Spec.Gateway
+	parentRef := map[string]any{"name": gateway.Name}
+	if gateway.Namespace != "" {
+		parentRef["namespace"] = gateway.Namespace
+	}
+	if gateway.SectionName != "" {
+		parentRef["sectionName"] = gateway.SectionName
+	}
+
+	hostnames := []any{}
+	for _, host := range apiSet.Spec.AllHosts() {
+		hostnames = append(hostnames, host)
+	}
+
+	matches := []any{}
+	// APIs may share paths, e.g. with different methods or hosts
+	seen := map[[2]string]bool{}
+	addMatch := func(value, matchType string) {
+		if seen[[2]string{value, matchType}] {
+			return
+		}
+		seen[[2]string{value, matchType}] = true
+		matches = append(matches, pathMatch(value, matchType))
+	}
+	for _, api := range apiSet.Spec.APIs {
+		addMatch(pathSpecToMatch(api.Path))
+	}
+	addMatch(internal.KcgidOpenAPIEndpointPath, pathMatchExact)
+	if apiSet.Spec.ArtifactStorage != nil {
+		addMatch(internal.KcgidArtifactsEndpointPath, pathMatchPathPrefix)
+	}
+
+	// split across rules of the same backend, as matches of each are limited
+	rules := []any{}
+	for len(matches) != 0 {
+		n := min(len(matches), httpRouteMaxMatches)
+		rules = append(rules, map[string]any{
+			"matches": matches[:n],
+			"backendRefs": []any{
+				map[string]any{
+					"name": service,
+					"port": int64(80),
+				},
+			},
+		})
+		matches = matches[n:]
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]any{
+		"spec": map[string]any{
+			"parentRefs": []any{parentRef},
+			"hostnames":  hostnames,
+			"rules":      rules,
+		},
+	}}
+	route.SetGroupVersionKind(httpRouteGVK)
+	return route
+}
+
+// reflects acceptance of route by the gateway as reported in route status
+func routeAcceptedCondition(apiSet *kubecgiv1alpha1.APISet, route *unstructured.Unstructured) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               kubecgiv1alpha1.ConditionRouteAccepted,
+		Status:             metav1.ConditionUnknown,
+		ObservedGeneration: apiSet.Generation,
+		Reason:             "Pending",
+		Message:            "Waiting for the Gateway to report status",
+	}
+
+	gateway := apiSet.Spec.Gateway
+	namespace := gateway.Namespace
+	if namespace == "" {
+		namespace = apiSet.Namespace
+	}
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	for _, p := range parents {
+		parent, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(parent, "parentRef", "name")
+		parentNamespace, _, _ := unstructured.NestedString(parent, "parentRef", "namespace")
+		sectionName, _, _ := unstructured.NestedString(parent, "parentRef", "sectionName")
+		if parentNamespace == "" {
+			parentNamespace = route.GetNamespace()
+		}
+		if name != gateway.Name || parentNamespace != namespace || sectionName != gateway.SectionName {
+			continue
+		}
+
+		conditions, _, _ := unstructured.NestedSlice(parent, "conditions")
+		for _, c := range conditions {
+			c, ok := c.(map[string]any)
+			if !ok || c["type"] != "Accepted" {
+				continue
+			}
+			generation, _, _ := unstructured.NestedInt64(c, "observedGeneration")
+			if generation != route.GetGeneration() {
+				// not yet of the current route
+				break
+			}
+			status, _, _ := unstructured.NestedString(c, "status")
+			reason, _, _ := unstructured.NestedString(c, "reason")
+			message, _, _ := unstructured.NestedString(c, "message")
+			condition.Status = metav1.ConditionStatus(status)
+			condition.Reason = reason
+			condition.Message = message
+			break
+		}
+	}
+	return condition
+}
+
+// sets route acceptance condition, or removes it if not using routes
+func setRouteAcceptedCondition(apiSet *kubecgiv1alpha1.APISet, route *unstructured.Unstructured) {
+	if route == nil {
+		meta.RemoveStatusCondition(&apiSet.Status.Conditions, kubecgiv1alpha1.ConditionRouteAccepted)
+		return
+	}
+	meta.SetStatusCondition(&apiSet.Status.Conditions, routeAcceptedCondition(apiSet, route))
+}
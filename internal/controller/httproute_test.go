@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+)
+
+func TestPathSpecToMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, value, matchType string
+	}{
+		{"/items", "/items", pathMatchExact},
+		{"/items/", "/items/", pathMatchPathPrefix},
+		{"/items/{$}", "/items/", pathMatchExact},
+		{"/items/{id}", "^/items/[^/]+$", pathMatchRegularExpression},
+		{"/items/{id}/", "^/items/[^/]+/.*$", pathMatchRegularExpression},
+		{"/items/{id}/{$}", "^/items/[^/]+/$", pathMatchRegularExpression},
+		{"/files/{path...}", "^/files/.*$", pathMatchRegularExpression},
+		{"/v1.0/{id}", `^/v1\.0/[^/]+$`, pathMatchRegularExpression},
+	} {
+		value, matchType := pathSpecToMatch(c.pattern)
+		if value != c.value || matchType != c.matchType {
+			t.Errorf("%s: expected %s %s, got %s %s", c.pattern, c.matchType, c.value, matchType, value)
+		}
+	}
+}
+
+func TestBuildHTTPRouteSplitsRules(t *testing.T) {
+	apiSet := &kubecgiv1alpha1.APISet{
+		Spec: kubecgiv1alpha1.APISetSpec{
+			Host:    "example.local",
+			Gateway: &kubecgiv1alpha1.GatewayRef{Name: "gateway"},
+		},
+	}
+	for i := 0; i < httpRouteMaxMatches; i++ {
+		path := fmt.Sprintf("/items/%d", i)
+		apiSet.Spec.APIs = append(apiSet.Spec.APIs,
+			kubecgiv1alpha1.API{Path: path, Methods: []string{"GET"}},
+			kubecgiv1alpha1.API{Path: path, Methods: []string{"POST"}})
+	}
+	route := buildHTTPRoute(apiSet, "test")
+
+	rules, _, err := unstructured.NestedSlice(route.Object, "spec", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, rule := range rules {
+		matches, _, _ := unstructured.NestedSlice(rule.(map[string]any), "matches")
+		if len(matches) > httpRouteMaxMatches {
+			t.Errorf("rule with %d matches exceeds limit", len(matches))
+		}
+		total += len(matches)
+	}
+	// deduplicated, with that of openapi
+	if len(rules) != 2 || total != httpRouteMaxMatches+1 {
+		t.Errorf("expected %d matches in 2 rules, got %d in %d", httpRouteMaxMatches+1, total, len(rules))
+	}
+}
+
+func TestRouteAcceptedCondition(t *testing.T) {
+	apiSet := &kubecgiv1alpha1.APISet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Generation: 2},
+		Spec: kubecgiv1alpha1.APISetSpec{
+			Host:    "example.local",
+			Gateway: &kubecgiv1alpha1.GatewayRef{Name: "gateway"},
+		},
+	}
+	route := buildHTTPRoute(apiSet, "test")
+	route.SetNamespace("default")
+	route.SetGeneration(1)
+
+	if c := routeAcceptedCondition(apiSet, route); c.Status != metav1.ConditionUnknown {
+		t.Errorf("expected unknown without status, got %v", c)
+	}
+
+	parents := []any{
+		map[string]any{
+			"parentRef": map[string]any{"name": "other"},
+			"conditions": []any{
+				map[string]any{"type": "Accepted", "status": "True", "reason": "Accepted", "observedGeneration": int64(1)},
+			},
+		},
+		map[string]any{
+			"parentRef": map[string]any{"name": "gateway", "namespace": "default"},
+			"conditions": []any{
+				map[string]any{"type": "Accepted", "status": "False", "reason": "NotAllowedByListeners", "observedGeneration": int64(1)},
+			},
+		},
+	}
+	if err := unstructured.SetNestedSlice(route.Object, parents, "status", "parents"); err != nil {
+		t.Fatal(err)
+	}
+	c := routeAcceptedCondition(apiSet, route)
+	if c.Status != metav1.ConditionFalse || c.Reason != "NotAllowedByListeners" || c.ObservedGeneration != 2 {
+		t.Errorf("expected not accepted by the gateway, got %v", c)
+	}
+}
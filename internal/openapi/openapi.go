@@ -0,0 +1,374 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/cgid"
+	"github.com/xdavidwu/kube-cgi/internal/schema"
+)
+
+// subset of OpenAPI 3.1, where schemas are JSON Schema 2020-12 as ours
+
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers,omitempty"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+// by lower case method
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Servers     []Server              `json:"servers,omitempty"`
+}
+
+type Parameter struct {
+	Name        string          `json:"name"`
+	In          string          `json:"in"`
+	Description string          `json:"description,omitempty"`
+	Required    bool            `json:"required"`
+	Schema      json.RawMessage `json:"schema"`
+}
+
+type RequestBody struct {
+	Content map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]json.RawMessage `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme  `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+const (
+	preSharedScheme = "preShared"
+	errorSchema     = "Error"
+)
+
+var (
+	stringSchema = json.RawMessage(`{"type":"string"}`)
+	objectSchema = json.RawMessage(`{"type":"object"}`)
+
+	simpleErrorSchema = json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"error": {"type": "string"},
+			"requestId": {"type": "string"},
+			"errors": {"type": "array", "items": {"type": "object"}}
+		},
+		"required": ["error"]
+	}`)
+	problemDetailsSchema = json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"type": {"type": "string", "format": "uri-reference"},
+			"title": {"type": "string"},
+			"status": {"type": "integer"},
+			"detail": {"type": "string"},
+			"instance": {"type": "string", "format": "uri-reference"},
+			"class": {"type": "string"},
+			"errors": {"type": "array", "items": {"type": "object"}}
+		}
+	}`)
+)
+
+// converts ServeMux path pattern to OpenAPI path template, with parameters
+func pathTemplate(pattern string) (string, []Parameter) {
+	segments := strings.Split(pattern, "/")
+	params := []Parameter{}
+	for i, s := range segments {
+		if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+			continue
+		}
+		name := s[1 : len(s)-1]
+		if name == "$" {
+			// exact match of trailing slash
+			segments[i] = ""
+			continue
+		}
+		description := ""
+		if rest, ok := strings.CutSuffix(name, "..."); ok {
+			name = rest
+			description = "Remaining path, may contain /"
+		}
+		segments[i] = "{" + name + "}"
+		params = append(params, Parameter{
+			Name:        name,
+			In:          "path",
+			Description: description,
+			Required:    true,
+			Schema:      stringSchema,
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func operationFor(api *kubecgiv1alpha1.API, requestSchema, responseSchema json.RawMessage, errorResponse Response) *Operation {
+	op := &Operation{
+		Responses: map[string]Response{
+			"default": {Description: "Response of the CGI script"},
+		},
+	}
+	if responseSchema != nil {
+		op.Responses["2XX"] = Response{
+			Description: "Successful response of the CGI script",
+			Content: map[string]MediaType{
+				"application/json": {Schema: responseSchema},
+			},
+		}
+	}
+
+	if api.Request == nil {
+		return op
+	}
+	content := map[string]MediaType{}
+	if requestSchema != nil {
+		content["application/json"] = MediaType{Schema: requestSchema}
+		op.Responses[strconv.Itoa(http.StatusUnprocessableEntity)] = errorResponse
+	}
+	if api.Request.Form != nil {
+		content["multipart/form-data"] = MediaType{Schema: objectSchema}
+	}
+	if len(content) != 0 {
+		op.RequestBody = &RequestBody{Content: content}
+	}
+	if a := api.Request.Authentication; a != nil && a.PreShared != nil {
+		op.Security = []map[string][]string{{preSharedScheme: {}}}
+		op.Responses[strconv.Itoa(http.StatusUnauthorized)] = errorResponse
+		op.Responses[strconv.Itoa(http.StatusForbidden)] = errorResponse
+	}
+	return op
+}
+
+// schema matching either, where nil matches any
+func eitherSchema(a, b json.RawMessage) json.RawMessage {
+	if a == nil || b == nil {
+		return nil
+	}
+	if bytes.Equal(a, b) {
+		return a
+	}
+	either, _ := json.Marshal(map[string][]json.RawMessage{"anyOf": {a, b}})
+	return either
+}
+
+func mergeContent(a, b map[string]MediaType) map[string]MediaType {
+	merged := map[string]MediaType{}
+	for k, m := range a {
+		merged[k] = m
+	}
+	for k, m := range b {
+		if existing, ok := merged[k]; ok {
+			m = MediaType{Schema: eitherSchema(existing.Schema, m.Schema)}
+		}
+		merged[k] = m
+	}
+	return merged
+}
+
+// merges operations of APIs sharing the path and method, e.g. restricted to
+// different hosts, as OpenAPI allows only one for each
+func mergeOperations(a, b *Operation) *Operation {
+	merged := *a
+	merged.Servers = nil
+	// otherwise served on all hosts
+	if len(a.Servers) != 0 && len(b.Servers) != 0 {
+		merged.Servers = append(slices.Clone(a.Servers), b.Servers...)
+	}
+
+	if a.RequestBody != nil || b.RequestBody != nil {
+		var aContent, bContent map[string]MediaType
+		if a.RequestBody != nil {
+			aContent = a.RequestBody.Content
+		}
+		if b.RequestBody != nil {
+			bContent = b.RequestBody.Content
+		}
+		merged.RequestBody = &RequestBody{Content: mergeContent(aContent, bContent)}
+	}
+
+	merged.Responses = map[string]Response{}
+	for code, r := range a.Responses {
+		merged.Responses[code] = r
+	}
+	for code, r := range b.Responses {
+		if existing, ok := merged.Responses[code]; ok {
+			existing.Content = mergeContent(existing.Content, r.Content)
+			r = existing
+		}
+		merged.Responses[code] = r
+	}
+
+	// either requirement, where empty one means optional
+	if a.Security != nil || b.Security != nil {
+		merged.Security = nil
+		for _, security := range [][]map[string][]string{a.Security, b.Security} {
+			if security == nil {
+				security = []map[string][]string{{}}
+			}
+			for _, requirement := range security {
+				if !slices.ContainsFunc(merged.Security, func(m map[string][]string) bool {
+					return reflect.DeepEqual(m, requirement)
+				}) {
+					merged.Security = append(merged.Security, requirement)
+				}
+			}
+		}
+	}
+	return &merged
+}
+
+// Build generates the OpenAPI document of the APISet, with schemas referring
+// others bundled into components, resolving those in ConfigMaps with
+// configMaps.
+// APIs serving all methods are documented under post if request body is
+// described, or get otherwise. Operations of APIs sharing the path and method
+// are merged, with schemas of either.
+func Build(apiSet *kubecgiv1alpha1.APISet, configMaps schema.ConfigMaps) ([]byte, error) {
+	errorMediaType, errorSchemaJSON := "application/json", simpleErrorSchema
+	if apiSet.Spec.ErrorFormat == kubecgiv1alpha1.ErrorFormatProblemDetails {
+		errorMediaType, errorSchemaJSON = "application/problem+json", problemDetailsSchema
+	}
+	errorResponse := Response{
+		Description: "Error generated by kcgid",
+		Content: map[string]MediaType{
+			errorMediaType: {Schema: json.RawMessage(`{"$ref":"#/components/schemas/` + errorSchema + `"}`)},
+		},
+	}
+
+	doc := Document{
+		OpenAPI: "3.1.0",
+		Info: Info{
+			Title:   apiSet.Name,
+			Version: strconv.FormatInt(apiSet.Generation, 10),
+		},
+		Paths: map[string]PathItem{},
+		Components: Components{
+			Schemas: map[string]json.RawMessage{errorSchema: errorSchemaJSON},
+		},
+	}
+
+	// with $ref, as components to appear once among methods
+	schemaFor := func(s *kubecgiv1alpha1.Schema, name string) (json.RawMessage, error) {
+		if s == nil {
+			return nil, nil
+		}
+		bundled, ok, err := schema.Bundle(s.RawJSON, "file:///"+name+".schema.json", configMaps)
+		if err != nil || !ok {
+			return bundled, err
+		}
+		doc.Components.Schemas[name] = bundled
+		return json.RawMessage(`{"$ref":"#/components/schemas/` + name + `"}`), nil
+	}
+
+	// wildcard ones are not usable as is
+	for _, host := range apiSet.Spec.AllHosts() {
+		if !strings.HasPrefix(host, "*") {
+			doc.Servers = append(doc.Servers, Server{URL: "http://" + host})
+		}
+	}
+
+	for i := range apiSet.Spec.APIs {
+		api := &apiSet.Spec.APIs[i]
+		path, params := pathTemplate(api.Path)
+		var requestSchema, responseSchema json.RawMessage
+		var err error
+		if api.Request != nil {
+			requestSchema, err = schemaFor(api.Request.Schema, fmt.Sprintf("API%dRequest", i))
+			if err != nil {
+				return nil, fmt.Errorf("cannot bundle request schema of %s: %w", api.Path, err)
+			}
+		}
+		if api.Response != nil {
+			responseSchema, err = schemaFor(api.Response.Schema, fmt.Sprintf("API%dResponse", i))
+			if err != nil {
+				return nil, fmt.Errorf("cannot bundle response schema of %s: %w", api.Path, err)
+			}
+		}
+		op := operationFor(api, requestSchema, responseSchema, errorResponse)
+		op.Parameters = params
+		for _, host := range api.Hosts {
+			op.Servers = append(op.Servers, Server{URL: "http://" + host})
+		}
+
+		if op.Security != nil {
+			doc.Components.SecuritySchemes = map[string]SecurityScheme{
+				preSharedScheme: {Type: "http", Scheme: "bearer"},
+			}
+		}
+
+		methods := []string{http.MethodGet}
+		if op.RequestBody != nil {
+			methods = []string{http.MethodPost}
+		}
+		if len(api.Methods) != 0 {
+			methods = api.Methods
+		}
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = PathItem{}
+		}
+		for _, method := range methods {
+			methodOp := op
+			if op.RequestBody != nil && (method == http.MethodGet || method == http.MethodHead) {
+				withoutBody := *op
+				withoutBody.RequestBody = nil
+				methodOp = &withoutBody
+			}
+			if existing := doc.Paths[path][strings.ToLower(method)]; existing != nil {
+				methodOp = mergeOperations(existing, methodOp)
+			}
+			doc.Paths[path][strings.ToLower(method)] = methodOp
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// Handler serves the document
+func Handler(doc []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			cgid.WriteError(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+}
@@ -0,0 +1,238 @@
+package openapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecgiv1alpha1 "github.com/xdavidwu/kube-cgi/api/v1alpha1"
+	"github.com/xdavidwu/kube-cgi/internal/openapi"
+	"github.com/xdavidwu/kube-cgi/internal/schema"
+)
+
+func TestBuild(t *testing.T) {
+	apiSet := &kubecgiv1alpha1.APISet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Generation: 3},
+		Spec: kubecgiv1alpha1.APISetSpec{
+			Host:        "example.local",
+			ErrorFormat: kubecgiv1alpha1.ErrorFormatProblemDetails,
+			APIs: []kubecgiv1alpha1.API{
+				{
+					Path: "/users/{id}/files/{path...}",
+					Request: &kubecgiv1alpha1.Request{
+						Schema: &kubecgiv1alpha1.Schema{RawJSON: `{"type":"object"}`},
+						Authentication: &kubecgiv1alpha1.Authentication{
+							PreShared: &kubecgiv1alpha1.PreShared{},
+						},
+					},
+					Response: &kubecgiv1alpha1.Response{
+						Schema: &kubecgiv1alpha1.Schema{RawJSON: `{"type":"array"}`},
+					},
+				},
+				{Path: "/status/{$}"},
+			},
+		},
+	}
+
+	b, err := openapi.Build(apiSet, nil)
+	if err != nil {
+		t.Fatalf("cannot build: %v", err)
+	}
+	var doc openapi.Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+
+	if doc.Info.Version != "3" || doc.Servers[0].URL != "http://example.local" {
+		t.Errorf("unexpected info or servers: %+v %+v", doc.Info, doc.Servers)
+	}
+
+	op := doc.Paths["/users/{id}/files/{path}"]["post"]
+	if op == nil {
+		t.Fatalf("operation with request body not under post: %+v", doc.Paths)
+	}
+	if len(op.Parameters) != 2 || op.Parameters[0].Name != "id" || op.Parameters[1].Name != "path" {
+		t.Errorf("unexpected parameters %+v", op.Parameters)
+	}
+	if string(op.RequestBody.Content["application/json"].Schema) != `{"type":"object"}` {
+		t.Errorf("unexpected request body %+v", op.RequestBody)
+	}
+	if string(op.Responses["2XX"].Content["application/json"].Schema) != `{"type":"array"}` {
+		t.Errorf("unexpected responses %+v", op.Responses)
+	}
+	for _, code := range []string{"401", "403", "422"} {
+		if _, ok := op.Responses[code].Content["application/problem+json"]; !ok {
+			t.Errorf("missing problem details response %s", code)
+		}
+	}
+	if len(op.Security) != 1 || doc.Components.SecuritySchemes["preShared"].Scheme != "bearer" {
+		t.Errorf("unexpected security %+v %+v", op.Security, doc.Components.SecuritySchemes)
+	}
+
+	if doc.Paths["/status/"]["get"] == nil {
+		t.Errorf("operation without request body not under get: %+v", doc.Paths)
+	}
+}
+
+func TestBuildMethods(t *testing.T) {
+	apiSet := &kubecgiv1alpha1.APISet{
+		Spec: kubecgiv1alpha1.APISetSpec{
+			APIs: []kubecgiv1alpha1.API{
+				{
+					Path:    "/items/{id}",
+					Methods: []string{"GET", "PUT"},
+					Request: &kubecgiv1alpha1.Request{
+						Schema: &kubecgiv1alpha1.Schema{RawJSON: `{"type":"object"}`},
+					},
+				},
+			},
+		},
+	}
+
+	b, err := openapi.Build(apiSet, nil)
+	if err != nil {
+		t.Fatalf("cannot build: %v", err)
+	}
+	var doc openapi.Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+
+	item := doc.Paths["/items/{id}"]
+	if len(item) != 2 || item["put"] == nil || item["get"] == nil {
+		t.Fatalf("unexpected operations %+v", item)
+	}
+	if item["put"].RequestBody == nil || item["get"].RequestBody != nil {
+		t.Errorf("request body expected only on put")
+	}
+}
+
+func TestBuildMergesHosts(t *testing.T) {
+	api := func(host, schema string) kubecgiv1alpha1.API {
+		return kubecgiv1alpha1.API{
+			Path:    "/items",
+			Methods: []string{"POST"},
+			Hosts:   []string{host},
+			Request: &kubecgiv1alpha1.Request{
+				Schema: &kubecgiv1alpha1.Schema{RawJSON: schema},
+			},
+		}
+	}
+	apiSet := &kubecgiv1alpha1.APISet{
+		Spec: kubecgiv1alpha1.APISetSpec{
+			Hosts: []string{"a.example.local", "b.example.local"},
+			APIs: []kubecgiv1alpha1.API{
+				api("a.example.local", `{"type":"object"}`),
+				api("b.example.local", `{"type":"array"}`),
+			},
+		},
+	}
+
+	b, err := openapi.Build(apiSet, nil)
+	if err != nil {
+		t.Fatalf("cannot build: %v", err)
+	}
+	var doc openapi.Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+
+	op := doc.Paths["/items"]["post"]
+	if op == nil || len(op.Servers) != 2 ||
+		op.Servers[0].URL != "http://a.example.local" || op.Servers[1].URL != "http://b.example.local" {
+		t.Fatalf("unexpected operation %+v", op)
+	}
+	var merged struct {
+		AnyOf []json.RawMessage `json:"anyOf"`
+	}
+	if err := json.Unmarshal(op.RequestBody.Content["application/json"].Schema, &merged); err != nil {
+		t.Fatalf("cannot decode request schema: %v", err)
+	}
+	if len(merged.AnyOf) != 2 || string(merged.AnyOf[0]) != `{"type":"object"}` ||
+		string(merged.AnyOf[1]) != `{"type":"array"}` {
+		t.Errorf("unexpected request schema %s", op.RequestBody.Content["application/json"].Schema)
+	}
+}
+
+func TestBuildBundlesSchemas(t *testing.T) {
+	configMaps := schema.ConfigMaps(func(name string) (map[string]string, error) {
+		if name != "common" {
+			return nil, fmt.Errorf("configmap %s not found", name)
+		}
+		return map[string]string{
+			"user.json": `{"type": "object", "properties": {"name": {"$ref": "name.json"}}, "required": ["name"]}`,
+			"name.json": `{"type": "string", "minLength": 1}`,
+		}, nil
+	})
+	apiSet := &kubecgiv1alpha1.APISet{
+		Spec: kubecgiv1alpha1.APISetSpec{
+			APIs: []kubecgiv1alpha1.API{
+				{
+					Path:    "/items",
+					Methods: []string{"POST", "PUT"},
+					Request: &kubecgiv1alpha1.Request{
+						Schema: &kubecgiv1alpha1.Schema{RawJSON: `{
+							"$defs": {"id": {"type": "integer"}},
+							"type": "object",
+							"properties": {
+								"id": {"$ref": "#/$defs/id"},
+								"owner": {"$ref": "configmap://common/user.json"}
+							}
+						}`},
+					},
+				},
+			},
+		},
+	}
+
+	b, err := openapi.Build(apiSet, configMaps)
+	if err != nil {
+		t.Fatalf("cannot build: %v", err)
+	}
+	var doc openapi.Document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+
+	ref := `{"$ref":"#/components/schemas/API0Request"}`
+	for _, method := range []string{"post", "put"} {
+		op := doc.Paths["/items"][method]
+		if op == nil || string(op.RequestBody.Content["application/json"].Schema) != ref {
+			t.Errorf("request body of %s not referring component: %+v", method, op)
+		}
+	}
+
+	bundled, ok := doc.Components.Schemas["API0Request"]
+	if !ok {
+		t.Fatalf("schema not bundled: %+v", doc.Components.Schemas)
+	}
+	sc, err := jsonschema.UnmarshalJSON(bytes.NewReader(bundled))
+	if err != nil {
+		t.Fatalf("cannot decode bundled schema: %v", err)
+	}
+	// self-contained, loading nothing
+	c := jsonschema.NewCompiler()
+	c.UseLoader(jsonschema.SchemeURLLoader{})
+	if err := c.AddResource("file:///openapi.json", sc); err != nil {
+		t.Fatalf("cannot add bundled schema: %v", err)
+	}
+	compiled, err := c.Compile("file:///openapi.json")
+	if err != nil {
+		t.Fatalf("cannot compile bundled schema: %v", err)
+	}
+	if err := compiled.Validate(map[string]any{"id": json.Number("1"), "owner": map[string]any{"name": "a"}}); err != nil {
+		t.Errorf("valid instance rejected: %v", err)
+	}
+	for _, invalid := range []map[string]any{
+		{"id": "1"},
+		{"owner": map[string]any{"name": ""}},
+	} {
+		if compiled.Validate(invalid) == nil {
+			t.Errorf("invalid instance %v accepted", invalid)
+		}
+	}
+}
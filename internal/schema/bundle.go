@@ -0,0 +1,134 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// keywords with instances rather than subschemas as values
+var instanceKeywords = map[string]bool{
+	"const":    true,
+	"enum":     true,
+	"default":  true,
+	"examples": true,
+}
+
+type bundler struct {
+	configMaps ConfigMaps
+	// by URL
+	resources map[string]any
+	refers    bool
+}
+
+// referred by $ref resolves to $id of the bundled resource
+func (b *bundler) load(u *url.URL) error {
+	key := u.String()
+	if _, ok := b.resources[key]; ok {
+		return nil
+	}
+	if b.configMaps == nil {
+		return fmt.Errorf("%s: configmaps not available", key)
+	}
+	doc, err := b.configMaps.Load(key)
+	if err != nil {
+		return err
+	}
+
+	object, ok := doc.(map[string]any)
+	if ok && object["$id"] == nil {
+		object["$id"] = key
+	} else {
+		// keeping its own $id, as relative to the URL
+		doc = map[string]any{"$id": key, "allOf": []any{doc}}
+	}
+	b.resources[key] = doc
+	return b.walk(doc, u)
+}
+
+func (b *bundler) walk(v any, base *url.URL) error {
+	switch v := v.(type) {
+	case map[string]any:
+		if id, ok := v["$id"].(string); ok {
+			u, err := base.Parse(id)
+			if err != nil {
+				return fmt.Errorf("cannot parse $id %s: %w", id, err)
+			}
+			base = u
+		}
+		if ref, ok := v["$ref"].(string); ok {
+			b.refers = true
+			u, err := base.Parse(ref)
+			if err != nil {
+				return fmt.Errorf("cannot parse $ref %s: %w", ref, err)
+			}
+			if u.Scheme == ConfigMapScheme {
+				u.Fragment = ""
+				if err := b.load(u); err != nil {
+					return err
+				}
+			}
+		}
+		for k, child := range v {
+			if instanceKeywords[k] {
+				continue
+			}
+			if err := b.walk(child, base); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if err := b.walk(child, base); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Bundle makes s self-contained as a JSON Schema 2020-12 compound document
+// if it has $ref, with $id set to id if absent, and resources referred in
+// ConfigMaps embedded in $defs with their URLs as $id, for use in other
+// documents. It reports whether s is changed.
+func Bundle(s, id string, configMaps ConfigMaps) (json.RawMessage, bool, error) {
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(s))
+	if err != nil {
+		return nil, false, err
+	}
+	root, ok := doc.(map[string]any)
+	if !ok {
+		return json.RawMessage(s), false, nil
+	}
+	if root["$id"] == nil {
+		root["$id"] = id
+	}
+	base, err := url.Parse(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b := &bundler{configMaps: configMaps, resources: map[string]any{}}
+	if err := b.walk(root, base); err != nil {
+		return nil, false, err
+	}
+	if !b.refers {
+		return json.RawMessage(s), false, nil
+	}
+
+	if len(b.resources) != 0 {
+		defs, ok := root["$defs"].(map[string]any)
+		if !ok {
+			defs = map[string]any{}
+			root["$defs"] = defs
+		}
+		for k, resource := range b.resources {
+			defs[k] = resource
+		}
+	}
+	bundled, err := json.Marshal(root)
+	return bundled, true, err
+}
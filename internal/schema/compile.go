@@ -1,22 +1,75 @@
 package schema
 
 import (
+	"context"
+	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/santhosh-tekuri/jsonschema/v6"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	SchemaFileUrl = "file:///api.schema.json"
+
+	// configmap://<name>/<key>, in the namespace of the APISet
+	ConfigMapScheme = "configmap"
 )
 
-func CompileString(s string) (*jsonschema.Schema, error) {
+// ConfigMaps gets data of ConfigMaps by name, for resolving $ref
+type ConfigMaps func(name string) (map[string]string, error)
+
+// ConfigMapsFrom gets ConfigMaps in the namespace with c
+func ConfigMapsFrom(ctx context.Context, c client.Reader, namespace string) ConfigMaps {
+	return func(name string) (map[string]string, error) {
+		cm := &corev1.ConfigMap{}
+		err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, cm)
+		if err != nil {
+			return nil, err
+		}
+		return cm.Data, nil
+	}
+}
+
+// Load implements jsonschema.URLLoader
+func (c ConfigMaps) Load(u string) (any, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Host == "" || key == "" {
+		return nil, fmt.Errorf("%s: expected %s://<name>/<key>", u, ConfigMapScheme)
+	}
+	data, err := c(parsed.Host)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := data[key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in configmap %s", key, parsed.Host)
+	}
+	return jsonschema.UnmarshalJSON(strings.NewReader(v))
+}
+
+// CompileString compiles s, with $ref to ConfigMaps resolved with configMaps
+// if not nil. Other external resources, including local files, are not
+// loaded.
+func CompileString(s string, configMaps ConfigMaps) (*jsonschema.Schema, error) {
 	sc, err := jsonschema.UnmarshalJSON(strings.NewReader(s))
 	if err != nil {
 		return nil, err
 	}
 
+	loader := jsonschema.SchemeURLLoader{}
+	if configMaps != nil {
+		loader[ConfigMapScheme] = configMaps
+	}
+
 	c := jsonschema.NewCompiler()
+	c.UseLoader(loader)
 	c.AddResource(SchemaFileUrl, sc)
 	return c.Compile(SchemaFileUrl)
 }
@@ -0,0 +1,57 @@
+package schema_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/xdavidwu/kube-cgi/internal/schema"
+)
+
+var configMaps = schema.ConfigMaps(func(name string) (map[string]string, error) {
+	data, ok := map[string]map[string]string{
+		"common": {
+			"user.json": `{"type": "object", "properties": {"name": {"$ref": "name.json"}}, "required": ["name"]}`,
+			"name.json": `{"type": "string", "minLength": 1}`,
+		},
+		"other": {
+			"group.json": `{"type": "array", "items": {"$ref": "configmap://common/user.json"}}`,
+		},
+	}[name]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s not found", name)
+	}
+	return data, nil
+})
+
+func TestCompileWithConfigMaps(t *testing.T) {
+	s, err := schema.CompileString(`{"$ref": "configmap://other/group.json"}`, configMaps)
+	if err != nil {
+		t.Fatalf("cannot compile: %v", err)
+	}
+	if err := s.Validate([]any{map[string]any{"name": "a"}}); err != nil {
+		t.Errorf("valid instance rejected: %v", err)
+	}
+	// via relative $ref between keys
+	if err := s.Validate([]any{map[string]any{"name": ""}}); err == nil {
+		t.Errorf("invalid instance accepted")
+	}
+}
+
+func TestCompileUnresolvable(t *testing.T) {
+	for _, ref := range []string{
+		"configmap://missing/user.json",
+		"configmap://common/missing.json",
+		"configmap://common",
+		"file:///etc/hostname",
+	} {
+		_, err := schema.CompileString(fmt.Sprintf(`{"$ref": %q}`, ref), configMaps)
+		if err == nil {
+			t.Errorf("%s: expected error", ref)
+		}
+	}
+
+	_, err := schema.CompileString(`{"$ref": "configmap://common/user.json"}`, nil)
+	if err == nil {
+		t.Errorf("configmap resolved without configMaps")
+	}
+}
@@ -1,12 +1,20 @@
 package internal
 
 const (
-	KcgidEnvAPISetNamespace  = "APISET_NAMESPACE"
-	KcgidEnvAPISetName       = "APISET_NAME"
-	KcgidEnvAPISetGeneration = "APISET_GENERATION"
+	KcgidEnvAPISetNamespace = "APISET_NAMESPACE"
+	KcgidEnvAPISetName      = "APISET_NAME"
 
 	KcgidPort        = 1234
 	KcgidMetricsPort = 5678
 
 	KcgidReadinessEndpointPath = "/readyz"
+	KcgidArtifactsEndpointPath = "/artifacts/"
+	KcgidOpenAPIEndpointPath   = "/openapi.json"
+
+	// key of the OpenAPI document in the ConfigMap published by manager
+	OpenAPIConfigMapKey = "openapi.json"
+
+	KcgidArtifactsMountPath = "/var/lib/kcgid/artifacts"
+	// PersistentVolumeClaims for forms are mounted under it by claim name
+	KcgidFormsMountPath = "/var/lib/kcgid/forms"
 )